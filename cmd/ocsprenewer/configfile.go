@@ -0,0 +1,183 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+// The config file is TOML.  Top-level keys are flag names, without the dash,
+// and take the same values as on the command line; repeatable flags take an
+// array, and key=value flags can also take a table.  A flag given on the
+// command line wins over the file.  The inputs key lists the certs (or with
+// dirs, the directories) to use when none are given on the command line;
+// entries may be globs, expanded at startup and on each reload (SIGHUP).
+//
+// Each [[cert]] block overrides settings for the certs it matches; see
+// renew.CertPolicy.
+//
+//	out-dir = "/var/spool/exim/ocsp"
+//	dirs = true
+//	inputs = ["/etc/ssl/exim", "/etc/ssl/web/*"]
+//
+//	[[cert]]
+//	match = "/etc/ssl/web"
+//	out-dir = "/etc/nginx/ocsp"
+//	hook = ["nginx -s reload"]
+//
+//	[[cert]]
+//	match = "/etc/ssl/*/internal-*.crt"
+//	responder = ["http://ocsp.internal.example/"]
+//	allow-nonocsp-in-dir = true
+
+// Top-level keys which are flags but make no sense in the file
+var notInConfigFile = map[string]bool{
+	"config":  true,
+	"version": true,
+}
+
+type certBlock struct {
+	Match             string   `toml:"match"`
+	TimerT1           float64  `toml:"timer-t1"`
+	OutDir            string   `toml:"out-dir"`
+	Extension         string   `toml:"extension"`
+	Layout            string   `toml:"layout"`
+	Output            []string `toml:"output"`
+	AllowNonOCSPInDir *bool    `toml:"allow-nonocsp-in-dir"`
+	Responder         []string `toml:"responder"`
+	Hook              []string `toml:"hook"`
+}
+
+// loadConfigFile applies the file at path to the flags not already set on
+// the command line and to cfg.
+func loadConfigFile(path string, cfg *renew.Config) error {
+	var settings map[string]interface{}
+	if _, err := toml.DecodeFile(path, &settings); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, name := range keys {
+		value := settings[name]
+		switch name {
+		case "cert":
+			continue
+		case "inputs":
+			inputs, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: inputs: expected an array", path)
+			}
+			if flag.NArg() == 0 {
+				for _, in := range inputs {
+					expanded, err := expandInput(fmt.Sprint(in))
+					if err != nil {
+						return fmt.Errorf("%s: inputs: %w", path, err)
+					}
+					cfg.InputPaths = append(cfg.InputPaths, expanded...)
+				}
+			}
+			continue
+		}
+		if flag.Lookup(name) == nil || notInConfigFile[name] {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if cmdlineExplicit[name] {
+			continue
+		}
+		if err := setFlagFromFile(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+
+	var blocks struct {
+		Cert []certBlock `toml:"cert"`
+	}
+	md, err := toml.DecodeFile(path, &blocks)
+	if err != nil {
+		return err
+	}
+	for _, k := range md.Undecoded() {
+		if len(k) > 1 && k[0] == "cert" {
+			return fmt.Errorf("%s: unknown setting %q in [[cert]]", path, k.String())
+		}
+	}
+
+	for i, b := range blocks.Cert {
+		if b.Match == "" {
+			return fmt.Errorf("%s: [[cert]] block %d has no match", path, i+1)
+		}
+		policy := renew.CertPolicy{
+			Match:             b.Match,
+			TimerT1:           b.TimerT1,
+			OutputDir:         b.OutDir,
+			Extension:         b.Extension,
+			OutputLayout:      b.Layout,
+			AllowNonOCSPInDir: b.AllowNonOCSPInDir,
+			ResponderURLs:     b.Responder,
+			Hooks:             b.Hook,
+		}
+		for _, o := range b.Output {
+			spec, err := renew.ParseOutputSpec(o)
+			if err != nil {
+				return fmt.Errorf("%s: [[cert]] %q: %w", path, b.Match, err)
+			}
+			policy.Outputs = append(policy.Outputs, spec)
+		}
+		cfg.Policies = append(cfg.Policies, policy)
+	}
+
+	return nil
+}
+
+// expandInput expands an inputs entry if it's a glob.
+func expandInput(in string) ([]string, error) {
+	if !strings.ContainsAny(in, "*?[") {
+		return []string{in}, nil
+	}
+	matches, err := filepath.Glob(in)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", in, err)
+	}
+	return matches, nil
+}
+
+func setFlagFromFile(name string, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if err := flag.Set(name, fmt.Sprint(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := flag.Set(name, k+"="+fmt.Sprint(v[k])); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return flag.Set(name, fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+// writeConfigFile writes contents to a config file, clearing the list and
+// map settings which loading it appends to, and arranges for the flag values
+// to be put back afterwards.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	saved, savedExplicit := renewerConfig, cmdlineExplicit
+	t.Cleanup(func() { renewerConfig, cmdlineExplicit = saved, savedExplicit })
+	cmdlineExplicit = nil
+	renewerConfig.InputPaths = nil
+	renewerConfig.Hooks = nil
+	renewerConfig.ResponderMethods = nil
+	renewerConfig.Policies = nil
+
+	path := filepath.Join(t.TempDir(), "ocsprenewer.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+extension = ".from-file"
+format = "pem"
+timer-t1 = 60
+hook = ["reload a", "reload b"]
+inputs = ["/etc/ssl/a.crt", "/etc/ssl/b.crt"]
+
+[responder-method]
+"ocsp.example" = "post"
+
+[[cert]]
+match = "/etc/ssl/web"
+out-dir = "/etc/nginx/ocsp"
+hook = []
+
+[[cert]]
+match = "/etc/ssl/*/internal-*.crt"
+output = ["/srv/ocsp,ext=.der"]
+responder = ["http://ocsp.internal.example/"]
+allow-nonocsp-in-dir = true
+`)
+	// As if given on the command line, so the file mustn't override it.
+	renewerConfig.Extension = ".cmdline"
+	cmdlineExplicit = map[string]bool{"extension": true}
+
+	if err := loadConfigFile(path, &renewerConfig); err != nil {
+		t.Fatalf("loadConfigFile: %s", err)
+	}
+	c := renewerConfig
+
+	if c.Extension != ".cmdline" {
+		t.Errorf("extension %q: the command line should win over the file", c.Extension)
+	}
+	if c.OutputFormat != "pem" || c.TimerT1 != 60 {
+		t.Errorf("format %q, timer-t1 %v: want pem and 60 from the file", c.OutputFormat, c.TimerT1)
+	}
+	if want := []string{"reload a", "reload b"}; !reflect.DeepEqual(c.Hooks, want) {
+		t.Errorf("hooks %q, want %q", c.Hooks, want)
+	}
+	if want := map[string]string{"ocsp.example": "post"}; !reflect.DeepEqual(c.ResponderMethods, want) {
+		t.Errorf("responder methods %v, want %v", c.ResponderMethods, want)
+	}
+	if want := []string{"/etc/ssl/a.crt", "/etc/ssl/b.crt"}; !reflect.DeepEqual(c.InputPaths, want) {
+		t.Errorf("inputs %q, want %q", c.InputPaths, want)
+	}
+
+	allow := true
+	wantPolicies := []renew.CertPolicy{
+		{Match: "/etc/ssl/web", OutputDir: "/etc/nginx/ocsp", Hooks: []string{}},
+		{
+			Match:             "/etc/ssl/*/internal-*.crt",
+			Outputs:           []renew.OutputSpec{{Dir: "/srv/ocsp", Extension: ".der"}},
+			AllowNonOCSPInDir: &allow,
+			ResponderURLs:     []string{"http://ocsp.internal.example/"},
+		},
+	}
+	if !reflect.DeepEqual(c.Policies, wantPolicies) {
+		t.Errorf("policies %+v, want %+v", c.Policies, wantPolicies)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"unknown setting", `colour = "blue"`, `unknown setting "colour"`},
+		{"not for the file", `config = "/etc/other.toml"`, `unknown setting "config"`},
+		{"bad value", `concurrency = "lots"`, `concurrency`},
+		{"inputs not an array", `inputs = "/etc/ssl"`, `expected an array`},
+		{"unknown cert setting", "[[cert]]\nmatch = \"/etc/ssl\"\ncolour = \"blue\"", `unknown setting "cert.colour"`},
+		{"cert without match", "[[cert]]\nout-dir = \"/srv\"", `has no match`},
+		{"bad cert output", "[[cert]]\nmatch = \"/etc/ssl\"\noutput = [\"/srv,colour=blue\"]", `unknown key "colour"`},
+		{"not TOML", `out-dir = `, `expected value`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := loadConfigFile(writeConfigFile(t, tc.contents), &renewerConfig)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+// `ocsprenewer ctl [-socket path] command [args]` talks to the control
+// socket of a persistent run.  With -config, the socket is taken from the
+// control-socket key in that config file.  The exit status is 0 if the
+// command succeeded (for renew, if the renewal did), else 1; 2 for usage
+// errors.
+//
+// Suitable for use as a lego --renew-hook:
+//
+//	ocsprenewer ctl -socket /run/ocsprenewer.sock renew "$LEGO_CERT_PATH"
+
+const ctlUsage = `usage: %s ctl [-socket path | -config file] [-json] command [args]
+commands:
+  status               show all tracked certs
+  renew <cert-path>    renew that cert (under an input path) now, ignoring timers
+  sweep [-full]        check all certs soon, per timers (or not, with -full)
+  forget <cert-path>   stop tracking that cert until found again
+  next                 list upcoming scheduled checks
+`
+
+func isCtlInvocation() bool {
+	return len(os.Args) > 1 && os.Args[1] == "ctl"
+}
+
+func runCtl() int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() { stderr(ctlUsage, filepath.Base(os.Args[0])) }
+	socket := fs.String("socket", "", "path of the control socket")
+	configFile := fs.String("config", "", "TOML config file to take control-socket from")
+	asJSON := fs.Bool("json", false, "show the raw JSON response")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for a reply")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if *socket == "" && *configFile != "" {
+		var err error
+		if *socket, err = controlSocketFromConfig(*configFile); err != nil {
+			stderr("ctl: %s\n", err)
+			return 1
+		}
+	}
+	if *socket == "" {
+		stderr("ctl: no control socket given; use -socket or -config\n")
+		return 2
+	}
+
+	req := renew.ControlRequest{Command: fs.Arg(0), Args: fs.Args()[1:]}
+	if req.Command == renew.ControlSweep {
+		sweepFlags := flag.NewFlagSet("sweep", flag.ContinueOnError)
+		sweepFlags.BoolVar(&req.Full, "full", false, "ignore timers")
+		if err := sweepFlags.Parse(req.Args); err != nil {
+			return 2
+		}
+		req.Args = sweepFlags.Args()
+	}
+	// The daemon may well have a different working directory, so tell it
+	// ours; it matches paths against the ones it tracks.
+	if wd, err := os.Getwd(); err == nil {
+		req.Dir = wd
+	}
+
+	resp, err := renew.ControlCall(*socket, req, *timeout)
+	if err != nil {
+		stderr("ctl: %s\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	} else {
+		showCtlResponse(resp)
+	}
+	if !resp.OK {
+		if !*asJSON {
+			stderr("ctl: %s: %s\n", req.Command, resp.Error)
+		}
+		return 1
+	}
+	return 0
+}
+
+// controlSocketFromConfig reads just the control-socket key from a config
+// file, without applying anything else.
+func controlSocketFromConfig(path string) (string, error) {
+	var settings struct {
+		ControlSocket string `toml:"control-socket"`
+	}
+	if _, err := toml.DecodeFile(path, &settings); err != nil {
+		return "", err
+	}
+	if settings.ControlSocket == "" {
+		return "", errors.New(path + ": no control-socket setting")
+	}
+	return settings.ControlSocket, nil
+}
+
+func showCtlResponse(resp *renew.ControlResponse) {
+	if resp.Message != "" {
+		stdout("%s\n", resp.Message)
+	}
+	if resp.Status != nil {
+		stdout("pid %s, up since %s, next check at %s\n",
+			resp.Status.PID, resp.Status.Started.Format(time.RFC3339), showTime(resp.Status.EarliestNextRenew))
+		for i := range resp.Status.Certs {
+			showCertStatus(&resp.Status.Certs[i])
+		}
+	}
+	if resp.Cert != nil {
+		showCertStatus(resp.Cert)
+	}
+	for _, sc := range resp.Next {
+		stdout("%s  in %-12s  %s\n", sc.At.Format(time.RFC3339), time.Until(sc.At).Round(time.Second), sc.Path)
+	}
+}
+
+func showCertStatus(st *renew.CertStatus) {
+	stdout("%s\n", st.Path)
+	stdout("  label:       %s\n", st.Label)
+	stdout("  staple:      %s\n", st.StaplePath)
+	stdout("  valid:       %s to %s\n", showTime(st.ThisUpdate), showTime(st.NextUpdate))
+	result := st.LastResult
+	if st.LastError != "" {
+		result += ": " + st.LastError
+	}
+	stdout("  last result: %s (%s)\n", result, showTime(st.LastAttempt))
+	stdout("  next check:  %s\n", showTime(st.NextCheck))
+	if st.InDanger {
+		stdout("  IN DANGER, %d consecutive failures\n", st.ConsecutiveFailures)
+	}
+}
+
+func showTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,79 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+// stringList is a flag which can be repeated, each use appending to the list.
+type stringList []string
+
+func (sl *stringList) String() string {
+	if sl == nil {
+		return ""
+	}
+	return strings.Join(*sl, " ")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+// stringMap is a flag which can be repeated, each use being key=value.
+type stringMap map[string]string
+
+func (sm *stringMap) String() string {
+	if sm == nil || *sm == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*sm))
+	for k, v := range *sm {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (sm *stringMap) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	if *sm == nil {
+		*sm = make(map[string]string)
+	}
+	(*sm)[k] = v
+	return nil
+}
+
+// outputList is a flag which can be repeated, each use adding an output spec
+// as parsed by renew.ParseOutputSpec.
+type outputList []renew.OutputSpec
+
+func (ol *outputList) String() string {
+	if ol == nil {
+		return ""
+	}
+	dirs := make([]string, len(*ol))
+	for i := range *ol {
+		dirs[i] = (*ol)[i].Dir
+	}
+	return strings.Join(dirs, " ")
+}
+
+func (ol *outputList) Set(s string) error {
+	spec, err := renew.ParseOutputSpec(s)
+	if err != nil {
+		return err
+	}
+	*ol = append(*ol, spec)
+	return nil
+}
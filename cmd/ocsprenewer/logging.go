@@ -0,0 +1,185 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// reopenLog reopens the log file, if we have one; in persist mode SIGHUP
+// calls it, for logrotate and friends.
+var reopenLog = func() error { return nil }
+
+// setupLogging returns the log handler per the logging flags, or nil to
+// leave the renewer logging to stderr.
+func setupLogging() (slog.Handler, error) {
+	level := new(slog.LevelVar)
+	if pflags.Verbose {
+		level.Set(renew.VerbosityLevel(1))
+	}
+
+	switch {
+	case pflags.Syslog && pflags.LogFile != "":
+		return nil, errors.New("-syslog and -log-file are mutually exclusive")
+
+	case pflags.Syslog:
+		facility, ok := syslogFacilities[strings.ToLower(pflags.SyslogFacility)]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", pflags.SyslogFacility)
+		}
+		w, err := syslog.New(facility|syslog.LOG_INFO, pflags.SyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		return newSyslogHandler(w, renewerConfig.LogFormat, level)
+
+	case pflags.LogFile != "":
+		f, err := openReopenableFile(pflags.LogFile)
+		if err != nil {
+			return nil, err
+		}
+		reopenLog = f.Reopen
+		return renew.NewLogHandler(f, renewerConfig.LogFormat, &slog.HandlerOptions{Level: level})
+	}
+
+	return nil, nil
+}
+
+// reopenableFile is a log file which can be reopened after it's been rotated
+// away, without losing writes made in between.
+type reopenableFile struct {
+	mu   sync.Mutex
+	path string
+	fh   *os.File
+}
+
+func openReopenableFile(path string) (*reopenableFile, error) {
+	rf := &reopenableFile{path: path}
+	if err := rf.Reopen(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *reopenableFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.fh.Write(p)
+}
+
+func (rf *reopenableFile) Reopen() error {
+	fh, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	old := rf.fh
+	rf.fh = fh
+	rf.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// syslogHandler formats records as the usual handler would, less the time
+// which syslog adds itself, then sends them with the syslog severity for the
+// record's level.
+type syslogHandler struct {
+	w     *syslog.Writer
+	inner slog.Handler
+
+	// shared with handlers derived by WithAttrs and WithGroup, since inner
+	// and its derivatives all write to buf
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func newSyslogHandler(w *syslog.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	buf := &bytes.Buffer{}
+	inner, err := renew.NewLogHandler(buf, format, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHandler{w: w, inner: inner, mu: &sync.Mutex{}, buf: buf}, nil
+}
+
+func (sh *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return sh.inner.Enabled(ctx, level)
+}
+
+func (sh *syslogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.buf.Reset()
+	if err := sh.inner.Handle(ctx, rec); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(sh.buf.String(), "\n")
+
+	switch {
+	case rec.Level >= slog.LevelError:
+		return sh.w.Err(msg)
+	case rec.Level >= slog.LevelWarn:
+		return sh.w.Warning(msg)
+	case rec.Level >= slog.LevelInfo:
+		return sh.w.Info(msg)
+	default:
+		return sh.w.Debug(msg)
+	}
+}
+
+func (sh *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *sh
+	derived.inner = sh.inner.WithAttrs(attrs)
+	return &derived
+}
+
+func (sh *syslogHandler) WithGroup(name string) slog.Handler {
+	derived := *sh
+	derived.inner = sh.inner.WithGroup(name)
+	return &derived
+}
@@ -0,0 +1,156 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"context"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+func TestReopenableFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ocsprenewer.log")
+	f, err := openReopenableFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(s string) {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("before\n")
+	// As logrotate does, before sending SIGHUP.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	write("between\n")
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	write("after\n")
+
+	for p, want := range map[string]string{rotated: "before\nbetween\n", path: "after\n"} {
+		if got, err := os.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s holds %q (%v), want %q", filepath.Base(p), got, err, want)
+		}
+	}
+}
+
+func TestSetupLoggingErrors(t *testing.T) {
+	saved := pflags
+	t.Cleanup(func() { pflags = saved })
+
+	pflags.Syslog, pflags.LogFile = true, filepath.Join(t.TempDir(), "log")
+	if _, err := setupLogging(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("-syslog with -log-file: got %v", err)
+	}
+
+	pflags.LogFile, pflags.SyslogFacility = "", "local9"
+	if _, err := setupLogging(); err == nil || !strings.Contains(err.Error(), `"local9"`) {
+		t.Errorf("bad facility: got %v", err)
+	}
+
+	pflags.Syslog = false
+	if h, err := setupLogging(); h != nil || err != nil {
+		t.Errorf("no logging flags: got %v, %v; want stderr default", h, err)
+	}
+}
+
+func TestSyslogHandler(t *testing.T) {
+	// Not t.TempDir(): socket paths have a short length limit.
+	dir, err := os.MkdirTemp("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("no unix datagram sockets: %s", err)
+	}
+	defer conn.Close()
+
+	w, err := syslog.Dial("unixgram", sock, syslog.LOG_DAEMON|syslog.LOG_INFO, "ocsprenewer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	h, err := newSyslogHandler(w, renew.LogFormatLogfmt, slog.LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("cert", "leaf.example")
+
+	for _, tc := range []struct {
+		level    slog.Level
+		priority string // daemon is facility 3
+	}{
+		{slog.LevelError, "<27>"},
+		{slog.LevelWarn, "<28>"},
+		{slog.LevelInfo, "<30>"},
+		{slog.LevelDebug, "<31>"},
+	} {
+		logger.Log(context.Background(), tc.level, "renewed")
+
+		buf := make([]byte, 2048)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(buf[:n])
+		if !strings.HasPrefix(got, tc.priority) {
+			t.Errorf("%s: got %q, want priority %s", tc.level, got, tc.priority)
+		}
+		if !strings.Contains(got, "msg=renewed cert=leaf.example") {
+			t.Errorf("%s: got %q, missing the record", tc.level, got)
+		}
+		if strings.Contains(got, "time=") {
+			t.Errorf("%s: got %q, which repeats the time syslog adds", tc.level, got)
+		}
+	}
+}
+
+func TestSetupLoggingFile(t *testing.T) {
+	saved, savedReopen := pflags, reopenLog
+	t.Cleanup(func() { pflags, reopenLog = saved, savedReopen })
+
+	path := filepath.Join(t.TempDir(), "ocsprenewer.log")
+	pflags.Syslog, pflags.LogFile = false, path
+	h, err := setupLogging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+
+	logger.Info("first")
+	if err := os.Rename(path, path+".0"); err != nil {
+		t.Fatal(err)
+	}
+	// What the persist-mode SIGHUP handler calls before reloading.
+	if err := reopenLog(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("second")
+
+	for p, want := range map[string]string{path + ".0": "msg=first", path: "msg=second"} {
+		got, err := os.ReadFile(p)
+		if err != nil || strings.Count(string(got), "\n") != 1 || !strings.Contains(string(got), want) {
+			t.Errorf("%s holds %q (%v), want one record with %s", filepath.Base(p), got, err, want)
+		}
+	}
+}
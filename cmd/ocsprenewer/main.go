@@ -6,6 +6,7 @@ package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
 
 import (
 	"flag"
+	"fmt"
 
 	// AVOID IMPORTING "os" HERE: use util.go for that.
 
@@ -21,15 +22,23 @@ const (
 const defHTTPUserAgent = defHTTPUserAgentProduct + " " + defHTTPUserAgentComment
 
 // We don't use "daemon" because we don't auto-fork into background, but
-// instead make ourselves easy to supervise.  If there are complaints that
-// daemonization is too hard, we can consider log-file redirection and
-// self-daemonization as later features.
+// instead make ourselves easy to supervise.  Logging can go to syslog or a
+// file, so the supervisor needn't redirect our output; if there are
+// complaints that daemonization is still too hard, we can consider
+// self-daemonization as a later feature.
 var pflags struct {
 	Persist   bool
 	IfNeeded  bool
 	Verbose   bool
 	NotReally bool
 	Version   bool
+
+	ConfigFile string
+
+	Syslog         bool
+	SyslogFacility string
+	SyslogTag      string
+	LogFile        string
 }
 
 var renewerConfig renew.Config
@@ -43,18 +52,79 @@ func init() {
 	flag.BoolVar(&pflags.NotReally, "not-really", false, "don't talk to remote servers, do everything else")
 	flag.BoolVar(&pflags.NotReally, "n", false, "short form of -not-really")
 	flag.BoolVar(&pflags.Version, "version", false, "show version and exit")
+	flag.StringVar(&pflags.ConfigFile, "config", "", "TOML config file; command-line flags override it")
+	flag.BoolVar(&pflags.Syslog, "syslog", false, "log to syslog instead of stderr")
+	flag.StringVar(&pflags.SyslogFacility, "syslog-facility", "daemon", "syslog facility to log with")
+	flag.StringVar(&pflags.SyslogTag, "syslog-tag", "ocsprenewer", "syslog tag (program name) to log with")
+	flag.StringVar(&pflags.LogFile, "log-file", "", "log to this file instead of stderr; with -persist, reopened on SIGHUP")
 
 	flag.BoolVar(&renewerConfig.Immediate, "now", false, "renew immediately in persist mode")
-	//TODO: flag.StringVar(&renewerConfig.HTTPStatus, "http", "", "start an HTTP status service, on given host:port spec")
+	flag.StringVar(&renewerConfig.StateFile, "state-file", "", "in persist mode, keep renewal schedule and status in this file across restarts")
+	flag.DurationVar(&renewerConfig.ShutdownTimeout, "shutdown-timeout", renew.DefaultShutdownTimeout, "on SIGTERM or SIGINT, how long to let work in progress finish")
+	flag.StringVar(&renewerConfig.LogFormat, "log-format", renew.LogFormatLogfmt, "how to write log records: logfmt, json")
+	flag.StringVar(&renewerConfig.ControlSocket, "control-socket", "", "in persist mode, accept commands from 'ocsprenewer ctl' on this Unix socket")
+	flag.StringVar(&renewerConfig.HTTPStatus, "http", "", "in persist mode, start an HTTP status service, on given host:port spec")
 	flag.BoolVar(&renewerConfig.Directories, "dirs", false, "arguments are directories containing certs")
+	flag.IntVar(&renewerConfig.Concurrency, "concurrency", 8, "how many certs to renew at once")
+	flag.IntVar(&renewerConfig.PerResponderConcurrency, "per-responder-concurrency", 2, "how many requests to make to any one OCSP responder at once")
+	flag.StringVar(&renewerConfig.ResponderOrder, "responder-order", renew.ResponderOrderListed, "order to try a cert's OCSP responders: listed, random, last-good")
+	flag.StringVar(&renewerConfig.RequestMethod, "ocsp-method", renew.RequestMethodAuto, "HTTP method for OCSP requests: auto (GET if short enough, else POST), get, post")
+	flag.Var((*stringMap)(&renewerConfig.ResponderMethods), "responder-method", "per-responder OCSP method override, as host=method (repeatable)")
+	flag.DurationVar(&renewerConfig.MaxClockSkew, "max-clock-skew", renew.DefaultMaxClockSkew, "reject responses whose thisUpdate is further than this in the future")
+	flag.DurationVar(&renewerConfig.MinValidity, "min-validity", 0, "reject responses valid for less than this")
+	flag.BoolVar(&renewerConfig.AllowStapleRegression, "allow-older-staple", false, "permit replacing a staple with an older or shorter-lived one")
+	flag.BoolVar(&renewerConfig.Watch, "watch", true, "with -dirs -persist, watch the directories for new, replaced and removed certs")
 	flag.StringVar(&renewerConfig.OutputDir, "out-dir", "./", "place files into given directory")
 	flag.StringVar(&renewerConfig.Extension, "extension", ".ocsp", "create proofs in files with this extension")
+	flag.StringVar(&renewerConfig.OutputFormat, "format", renew.FormatDER, "encoding of proofs on disk: der, pem, base64, json")
+	flag.StringVar(&renewerConfig.OutputLayout, "layout", renew.LayoutFlat, "where proofs go: flat (in -out-dir), beside (next to the cert), mirror (the input tree recreated under -out-dir)")
+	flag.Var((*outputList)(&renewerConfig.Outputs), "output", "write proofs to this destination, as dir[,ext=E][,format=F][,layout=L][,mode=0644][,owner=U][,group=G] (repeatable; replaces -out-dir)")
 	flag.Float64Var(&renewerConfig.TimerT1, "timer-t1", 0.5, "how far through staple validity period to start trying to renew")
+	flag.Float64Var(&renewerConfig.TimerT2, "timer-t2", renew.DefaultTimerT2, "how far through staple validity period it is in danger, and retries speed up")
+	flag.DurationVar(&renewerConfig.RetryBackoffMin, "retry-backoff-min", renew.DefaultRetryBackoffMin, "before T2, first retry interval after a failure, doubling per consecutive failure")
+	flag.DurationVar(&renewerConfig.RetryBackoffMax, "retry-backoff-max", renew.DefaultRetryBackoffMax, "before T2, longest retry interval after failures")
+	flag.DurationVar(&renewerConfig.RetryInDanger, "retry-in-danger", renew.DefaultRetryInDanger, "past T2, retry interval after failures")
 	flag.BoolVar(&renewerConfig.AllowNonOCSPInDir, "allow-nonocsp-in-dir", false, "do not error on certs missing OCSP info")
 	flag.StringVar(&renewerConfig.CertExtensions, "cert-extensions", ".crt .cert .pem", "files in dir-scan with these extensions should be certs")
+	flag.Var((*stringList)(&renewerConfig.Hooks), "hook", "shell command to run after staples are written, eg to reload a server (repeatable)")
+	flag.DurationVar(&renewerConfig.HookDebounce, "hook-debounce", renew.DefaultHookDebounce, "wait this long for further staple writes before running hooks")
+	flag.DurationVar(&renewerConfig.HookTimeout, "hook-timeout", renew.DefaultHookTimeout, "kill a hook which runs for longer than this")
+	flag.StringVar(&renewerConfig.RevocationPolicy, "revocation-policy", renew.RevocationKeep, "on finding a cert revoked: keep (the old staple), delete (the staples), write (the revoked response), move-aside (the cert)")
+	flag.Var((*stringList)(&renewerConfig.RevocationHooks), "revocation-hook", "shell command to run at once when a cert is found revoked (repeatable)")
+	flag.Var((*stringList)(&renewerConfig.WebhookURLs), "webhook", "URL to POST JSON notifications of failures, expiring staples, revocations and recoveries to (repeatable)")
+	flag.StringVar(&renewerConfig.WebhookSecret, "webhook-secret", "", "key for HMAC-SHA256 signatures of webhook bodies")
+	flag.DurationVar(&renewerConfig.ExpiryWarning, "expiry-warning", renew.DefaultExpiryWarning, "notify when a staple expires within this")
+	flag.DurationVar(&renewerConfig.NotifyRepeat, "notify-repeat", renew.DefaultNotifyRepeat, "do not repeat the same notification for a cert within this, until it recovers")
+	flag.Var((*stringList)(&renewerConfig.IssuerPaths), "issuers", "file or directory of issuer certs, for certs without bundled chain (repeatable)")
+	flag.BoolVar(&renewerConfig.SystemIssuers, "system-issuers", false, "also look for issuers in the OS trust-anchor bundle")
+	flag.BoolVar(&renewerConfig.FetchIssuers, "fetch-issuers", true, "download missing issuers from the cert's caIssuers URL")
+	flag.StringVar(&renewerConfig.IssuerCacheDir, "issuer-cache-dir", "", "keep downloaded issuers in this directory")
+}
+
+// buildRenewerConfig completes renewerConfig from the config file, if any,
+// and the command-line arguments.
+func buildRenewerConfig() error {
+	if pflags.ConfigFile != "" {
+		if err := loadConfigFile(pflags.ConfigFile, &renewerConfig); err != nil {
+			return fmt.Errorf("loading config file failed: %w", err)
+		}
+	}
+	if flag.NArg() > 0 {
+		renewerConfig.InputPaths = flag.Args()
+	}
+
+	renewerConfig.HTTPUserAgent = defHTTPUserAgent
+	if Version != "" {
+		renewerConfig.HTTPUserAgent = defHTTPUserAgentProduct + "/" + httpVersion(Version) + " " + defHTTPUserAgentComment
+	}
+	return nil
 }
 
 func main() {
+	if isCtlInvocation() {
+		exit(runCtl())
+	}
+
 	flag.Parse()
 
 	if pflags.Version {
@@ -62,12 +132,18 @@ func main() {
 		exit(0)
 	}
 
-	renewerConfig.InputPaths = flag.Args()
-	renewerConfig.HTTPUserAgent = defHTTPUserAgent
+	saveCmdline()
+	if err := buildRenewerConfig(); err != nil {
+		stderr("%s\n", err)
+		exit(1)
+	}
 
-	if Version != "" {
-		renewerConfig.HTTPUserAgent = defHTTPUserAgentProduct + "/" + httpVersion(Version) + " " + defHTTPUserAgentComment
+	logHandler, err := setupLogging()
+	if err != nil {
+		stderr("setting up logging failed: %s\n", err)
+		exit(1)
 	}
+	renewerConfig.LogHandler = logHandler
 
 	renewer, err := renew.New(renewerConfig)
 	if err != nil {
@@ -82,7 +158,7 @@ func main() {
 	}
 
 	if err := renewer.BasicChecks(); err != nil {
-		renewer.Logf("initial startup checks failed: %s", err)
+		renewer.Errorf("initial startup checks failed: %s", err)
 		exit(1)
 	}
 
@@ -90,7 +166,7 @@ func main() {
 		renewer.Logf("%s: starting persistent run, version %s", ProjectName, Version)
 		renewer.Logf("argv: %s", argvQuoted())
 		setupSignals(renewer)
-		// Should not return until exiting
+		// Returns true after a clean shutdown, on SIGTERM or SIGINT
 		ok := renewer.Start()
 		if ok {
 			exit(0)
@@ -107,8 +183,10 @@ func main() {
 	}
 
 	err = renewer.OneShot()
+	renewer.FlushHooks()
+	renewer.FlushNotifications()
 	if err != nil {
-		renewer.Logf("renewing failed: %s", err)
+		renewer.Errorf("renewing failed: %s", err)
 		exit(1)
 	}
 }
@@ -0,0 +1,66 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"flag"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+// The settings from the command line alone, before the config file is
+// applied, for a reload to start again from.  We note which flags were
+// given, since once the config file has set flags, flag.Visit can't tell.
+var (
+	cmdlineFlags    = pflags
+	cmdlineConfig   renew.Config
+	cmdlineExplicit map[string]bool
+)
+
+func saveCmdline() {
+	cmdlineFlags = pflags
+	cmdlineConfig = cloneConfig(renewerConfig)
+	cmdlineExplicit = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdlineExplicit[f.Name] = true })
+}
+
+// reloadConfig rebuilds the configuration, as at startup, and hands it to
+// the renewer, which rejects it if it doesn't pass validation; we then keep
+// what we had.  Logging settings are not reloaded.
+func reloadConfig(r *renew.Renewer) error {
+	prevFlags, prevConfig := pflags, renewerConfig
+	pflags = cmdlineFlags
+	renewerConfig = cloneConfig(cmdlineConfig)
+
+	err := buildRenewerConfig()
+	if err == nil {
+		err = r.Reload(renewerConfig)
+	}
+	if err != nil {
+		pflags, renewerConfig = prevFlags, prevConfig
+		return err
+	}
+	return nil
+}
+
+// cloneConfig copies the slices and maps which flags append to or modify, so
+// that changes to the copy don't show through in the original.
+func cloneConfig(c renew.Config) renew.Config {
+	c.InputPaths = append([]string(nil), c.InputPaths...)
+	c.Outputs = append([]renew.OutputSpec(nil), c.Outputs...)
+	c.Hooks = append([]string(nil), c.Hooks...)
+	c.Policies = append([]renew.CertPolicy(nil), c.Policies...)
+	c.RevocationHooks = append([]string(nil), c.RevocationHooks...)
+	c.WebhookURLs = append([]string(nil), c.WebhookURLs...)
+	c.IssuerPaths = append([]string(nil), c.IssuerPaths...)
+	if c.ResponderMethods != nil {
+		methods := make(map[string]string, len(c.ResponderMethods))
+		for k, v := range c.ResponderMethods {
+			methods[k] = v
+		}
+		c.ResponderMethods = methods
+	}
+	return c
+}
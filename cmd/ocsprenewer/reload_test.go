@@ -0,0 +1,72 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main // import "go.pennock.tech/ocsprenewer/cmd/ocsprenewer"
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.pennock.tech/ocsprenewer/renew"
+)
+
+func TestReloadConfig(t *testing.T) {
+	savedFlags, savedCmdFlags, savedCmdConfig := pflags, cmdlineFlags, cmdlineConfig
+	t.Cleanup(func() { pflags, cmdlineFlags, cmdlineConfig = savedFlags, savedCmdFlags, savedCmdConfig })
+
+	certs := t.TempDir()
+	mkdirs := func(names ...string) (dirs []string) {
+		for _, n := range names {
+			d := filepath.Join(certs, n)
+			if err := os.Mkdir(d, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			dirs = append(dirs, d)
+		}
+		return dirs
+	}
+	contents := fmt.Sprintf("out-dir = %q\ndirs = true\ninputs = [%q]\n", t.TempDir(), filepath.Join(certs, "*"))
+	path := writeConfigFile(t, contents)
+
+	want := mkdirs("a", "b")
+	pflags.ConfigFile = path
+	saveCmdline()
+	if err := buildRenewerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(renewerConfig.InputPaths, want) {
+		t.Fatalf("inputs %q, want %q", renewerConfig.InputPaths, want)
+	}
+	renewerConfig.LogHandler = slog.NewTextHandler(io.Discard, nil)
+	r, err := renew.New(renewerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The glob is expanded afresh, and the file read again from scratch
+	// rather than appending to what we had.
+	want = append(want, mkdirs("c")...)
+	if err := reloadConfig(r); err != nil {
+		t.Fatalf("reloadConfig: %s", err)
+	}
+	if !reflect.DeepEqual(renewerConfig.InputPaths, want) {
+		t.Errorf("after reload, inputs %q, want %q", renewerConfig.InputPaths, want)
+	}
+
+	mkdirs("d")
+	if err := os.WriteFile(path, []byte(contents+"concurrency = \"lots\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(r); err == nil {
+		t.Error("reload of a broken config file accepted")
+	}
+	if !reflect.DeepEqual(renewerConfig.InputPaths, want) {
+		t.Errorf("after failed reload, inputs %q, want %q kept", renewerConfig.InputPaths, want)
+	}
+}
@@ -30,6 +30,35 @@ func setupSignals(r *renew.Renewer) {
 	go handlerFunc(chNormal, false)
 	go handlerFunc(chFull, true)
 
-	signal.Notify(chNormal, syscall.SIGHUP, syscall.SIGUSR1)
+	signal.Notify(chNormal, syscall.SIGUSR1)
 	signal.Notify(chFull, syscall.SIGUSR2)
+
+	// SIGHUP first reopens any log file, for log rotation; a reload which
+	// changes nothing is cheap.
+	chReload := make(chan os.Signal, 1)
+	go func() {
+		for s := range chReload {
+			if err := reopenLog(); err != nil {
+				r.Errorf("reopening log file %q failed: %s", pflags.LogFile, err)
+			}
+			r.Logf("received signal %v, reloading configuration", s)
+			if err := reloadConfig(r); err != nil {
+				r.Errorf("reload rejected, keeping running configuration: %s", err)
+			}
+		}
+	}()
+	signal.Notify(chReload, syscall.SIGHUP)
+
+	// The first SIGTERM or SIGINT asks for a clean shutdown; if that's
+	// taking too long for someone's liking, a second one is more forceful.
+	chStop := make(chan os.Signal, 1)
+	go func() {
+		s := <-chStop
+		r.Logf("received signal %v, shutting down", s)
+		r.Shutdown()
+		s = <-chStop
+		r.Errorf("received signal %v while shutting down, exiting now", s)
+		exit(1)
+	}()
+	signal.Notify(chStop, syscall.SIGTERM, syscall.SIGINT)
 }
@@ -1,5 +1,11 @@
 module go.pennock.tech/ocsprenewer
 
-go 1.19
+go 1.21
 
-require golang.org/x/crypto v0.31.0
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/fsnotify/fsnotify v1.8.0
+	golang.org/x/crypto v0.31.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,237 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrNotPKCS7SignedData = errors.New("not a PKCS#7 SignedData structure")
+)
+
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// How long we leave a caIssuers URL alone after it fails us, so that every
+// cert naming it doesn't wait on it in each sweep.  Short, since the
+// failure may well be transient.
+const aiaFailureTTL = 5 * time.Minute
+
+// fetchIssuerViaAIA tries the Authority Information Access caIssuers URLs in
+// the cert, as a last resort when no issuer was bundled and the store doesn't
+// have one.  Anything we find is added to the issuer store, and to the on-disk
+// cache if there is one, so that we only download each issuer once.
+func (cr *CertRenewal) fetchIssuerViaAIA() *x509.Certificate {
+	if !cr.Renewer.config.FetchIssuers || len(cr.cert.IssuingCertificateURL) == 0 {
+		return nil
+	}
+	if !cr.Renewer.permitRemoteComms {
+		cr.CertLogf("remote comms inhibited, not fetching issuer from %q", cr.cert.IssuingCertificateURL[0])
+		return nil
+	}
+
+	for _, u := range cr.cert.IssuingCertificateURL {
+		if until, failing := cr.Renewer.aiaFailingUntil(u); failing {
+			cr.CertLogf("not fetching issuer from %q, which failed recently, until %s", u, until.Format(time.RFC3339))
+			continue
+		}
+		issuer, err := cr.fetchIssuerFrom(u)
+		if err != nil {
+			cr.CertLogf("fetching issuer from %q failed: %s", u, err)
+			if cr.ctx.Err() == nil {
+				cr.Renewer.aiaFailed(u)
+			}
+			continue
+		}
+		cr.CertLogf("fetched issuer %q from %q", certLabel(issuer), u)
+		if cr.Renewer.issuers.add(issuer) {
+			cr.Renewer.cacheIssuer(issuer)
+		}
+		return issuer
+	}
+	return nil
+}
+
+// aiaFailingUntil says whether u failed us within aiaFailureTTL, and if so
+// when we'll next try it.
+func (r *Renewer) aiaFailingUntil(u string) (time.Time, bool) {
+	r.aiaMutex.Lock()
+	defer r.aiaMutex.Unlock()
+	until, ok := r.aiaFailures[u]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(until) {
+		delete(r.aiaFailures, u)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (r *Renewer) aiaFailed(u string) {
+	r.aiaMutex.Lock()
+	defer r.aiaMutex.Unlock()
+	r.aiaFailures[u] = time.Now().Add(aiaFailureTTL)
+}
+
+func (cr *CertRenewal) fetchIssuerFrom(u string) (*x509.Certificate, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", parsed.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(cr.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cr.httpDo(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, MaxCertFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MaxCertFileSize {
+		return nil, ErrCertFileTooLarge
+	}
+
+	candidates, err := parseIssuerResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range candidates {
+		if cr.cert.CheckSignatureFrom(c) == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("none of %d certificates retrieved signed %q", len(candidates), cr.certLabel())
+}
+
+// parseIssuerResponse handles what we might get back from a caIssuers URL.
+// RFC 5280 says DER or a "certs-only" CMS message, but PEM is out there too.
+func parseIssuerResponse(raw []byte) ([]*x509.Certificate, error) {
+	block, rest := pem.Decode(raw)
+	if block == nil {
+		if cert, err := x509.ParseCertificate(raw); err == nil {
+			return []*x509.Certificate{cert}, nil
+		}
+		return parsePKCS7Certificates(raw)
+	}
+
+	var certs []*x509.Certificate
+	for block != nil {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		case "PKCS7":
+			more, err := parsePKCS7Certificates(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, more...)
+		}
+		block, rest = pem.Decode(rest)
+	}
+	if len(certs) == 0 {
+		return nil, ErrNotCertificate
+	}
+	return certs, nil
+}
+
+// Just enough of RFC 2315 / RFC 5652 to dig the certificates out; we don't
+// care about signatures here, since we check the cert signatures ourselves.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+func parsePKCS7Certificates(der []byte) ([]*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, ErrNotPKCS7SignedData
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, ErrNotCertificate
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
+
+// cacheIssuer stores the issuer into the configured cache directory, if any,
+// named for the SHA-256 of the cert so that repeats are harmless.  The cache
+// dir is loaded into the issuer store at startup.
+func (r *Renewer) cacheIssuer(issuer *x509.Certificate) {
+	if r.config.IssuerCacheDir == "" || !r.permitFileUpdate {
+		return
+	}
+	sum := sha256.Sum256(issuer.Raw)
+	fn := filepath.Join(r.config.IssuerCacheDir, hex.EncodeToString(sum[:])+".pem")
+	if _, err := os.Stat(fn); err == nil {
+		return
+	}
+
+	fh, err := os.CreateTemp(r.config.IssuerCacheDir, "newissuer")
+	if err != nil {
+		r.Logf("issuer cache: %s", err)
+		return
+	}
+	err = pem.Encode(fh, &pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw})
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fh.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), fn)
+	}
+	if err != nil {
+		_ = os.Remove(fh.Name())
+		r.Logf("issuer cache: failed to write %q: %s", fn, err)
+		return
+	}
+	r.Logf("issuer cache: stored %q as %q", certLabel(issuer), fn)
+}
@@ -0,0 +1,273 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certsOnlyPKCS7 builds the degenerate SignedData which CAs serve as
+// application/pkcs7-mime: certs and no signers.
+func certsOnlyPKCS7(t *testing.T, certs ...*x509.Certificate) []byte {
+	t.Helper()
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	dataContent, err := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{
+		asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      asn1.RawValue{FullBytes: dataContent},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentInfo, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contentInfo
+}
+
+func TestParseIssuerResponse(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	pemOf := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+	p7 := certsOnlyPKCS7(t, other.cert, ca.cert)
+
+	for _, tc := range []struct {
+		name    string
+		raw     []byte
+		want    []*x509.Certificate
+		wantErr error
+	}{
+		{name: "DER", raw: ca.cert.Raw, want: []*x509.Certificate{ca.cert}},
+		{name: "PEM", raw: pemOf("CERTIFICATE", ca.cert.Raw), want: []*x509.Certificate{ca.cert}},
+		{name: "PEM bundle with junk", raw: bytes.Join([][]byte{
+			pemOf("CERTIFICATE", other.cert.Raw), pemOf("X509 CRL", []byte("crl")), pemOf("CERTIFICATE", ca.cert.Raw),
+		}, nil), want: []*x509.Certificate{other.cert, ca.cert}},
+		{name: "PKCS#7", raw: p7, want: []*x509.Certificate{other.cert, ca.cert}},
+		{name: "PKCS#7 in PEM", raw: pemOf("PKCS7", p7), want: []*x509.Certificate{other.cert, ca.cert}},
+		{name: "PEM without certs", raw: pemOf("X509 CRL", []byte("crl")), wantErr: ErrNotCertificate},
+		{name: "PKCS#7 without certs", raw: certsOnlyPKCS7(t), wantErr: ErrNotCertificate},
+		{name: "some other CMS type", raw: func() []byte {
+			der, _ := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+			return der
+		}(), wantErr: ErrNotPKCS7SignedData},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseIssuerResponse(tc.raw)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("got %d certs, error %v; want error %v", len(got), err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d certs, want %d", len(got), len(tc.want))
+			}
+			for i := range got {
+				if !got[i].Equal(tc.want[i]) {
+					t.Errorf("cert %d is %q, want %q", i, got[i].Subject, tc.want[i].Subject)
+				}
+			}
+		})
+	}
+
+	if _, err := parseIssuerResponse([]byte("<html>Not Found</html>")); err == nil {
+		t.Error("an HTML error page should fail to parse")
+	}
+}
+
+func TestFetchIssuerViaAIA(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+
+	var requests []string
+	mux := http.NewServeMux()
+	serve := func(path string, body []byte) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req.URL.Path)
+			_, _ = w.Write(body)
+		})
+	}
+	serve("/ca.der", ca.cert.Raw)
+	serve("/ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	serve("/ca.p7c", certsOnlyPKCS7(t, other.cert, ca.cert))
+	serve("/other.der", other.cert.Raw)
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.Path)
+		http.NotFound(w, req)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cacheName := func(c *x509.Certificate) string {
+		sum := sha256.Sum256(c.Raw)
+		return hex.EncodeToString(sum[:]) + ".pem"
+	}
+
+	for _, tc := range []struct {
+		name  string
+		paths []string
+		want  bool // whether we should find ca
+		tried []string
+	}{
+		{"DER", []string{"/ca.der"}, true, []string{"/ca.der"}},
+		{"PEM", []string{"/ca.pem"}, true, []string{"/ca.pem"}},
+		{"PKCS#7 picks the signer", []string{"/ca.p7c"}, true, []string{"/ca.p7c"}},
+		{"falls through failures", []string{"/missing", "/other.der", "/ca.der", "/ca.pem"}, true, []string{"/missing", "/other.der", "/ca.der"}},
+		{"not the signer", []string{"/other.der"}, false, []string{"/other.der"}},
+		{"nothing there", []string{"/missing"}, false, []string{"/missing"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = nil
+			cacheDir := t.TempDir()
+			r := newTestRenewer(t, Config{FetchIssuers: true, IssuerCacheDir: cacheDir})
+			urls := make([]string, len(tc.paths))
+			for i, p := range tc.paths {
+				urls[i] = server.URL + p
+			}
+			leaf, _ := ca.issue(t, &x509.Certificate{IssuingCertificateURL: urls})
+			cr := &CertRenewal{Renewer: r, ctx: context.Background(), certPath: "leaf.crt", cert: leaf}
+
+			got := cr.fetchIssuerViaAIA()
+			if len(requests) != len(tc.tried) {
+				t.Errorf("requested %q, want %q", requests, tc.tried)
+			}
+			entries, err := os.ReadDir(cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.want {
+				if got != nil {
+					t.Errorf("found issuer %q, want none", got.Subject)
+				}
+				if r.issuers.size() != 0 || len(entries) != 0 {
+					t.Errorf("%d certs in the store and %d in the cache, want none", r.issuers.size(), len(entries))
+				}
+				return
+			}
+			if got == nil || !got.Equal(ca.cert) {
+				t.Fatalf("didn't find the issuer")
+			}
+			if r.issuers.lookup(leaf) == nil {
+				t.Error("fetched issuer not added to the store")
+			}
+			if len(entries) != 1 || entries[0].Name() != cacheName(ca.cert) {
+				t.Fatalf("cache dir holds %v, want just %s", entries, cacheName(ca.cert))
+			}
+			cached, err := os.ReadFile(filepath.Join(cacheDir, entries[0].Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if certs, err := parseCertificates(cached); err != nil || len(certs) != 1 || !certs[0].Equal(ca.cert) {
+				t.Errorf("cached file doesn't hold the issuer: %v", err)
+			}
+
+			// The cache is what the next run loads.
+			again := newTestRenewer(t, Config{IssuerPaths: []string{cacheDir}})
+			if again.issuers.lookup(leaf) == nil {
+				t.Error("issuer not found loading the cache dir")
+			}
+		})
+	}
+
+	// Without remote comms, we don't even try.
+	requests = nil
+	r := newTestRenewer(t, Config{FetchIssuers: true})
+	r.SetNotReally(true)
+	leaf, _ := ca.issue(t, &x509.Certificate{IssuingCertificateURL: []string{server.URL + "/ca.der"}})
+	if got := (&CertRenewal{Renewer: r, ctx: context.Background(), certPath: "leaf.crt", cert: leaf}).fetchIssuerViaAIA(); got != nil || len(requests) != 0 {
+		t.Errorf("with remote comms inhibited, got %v after requests %q", got, requests)
+	}
+}
+
+func TestFetchIssuerViaAIAFailureCached(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	var requests int
+	broken := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if broken {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(ca.cert.Raw)
+	}))
+	defer server.Close()
+
+	r := newTestRenewer(t, Config{FetchIssuers: true})
+	leaf, _ := ca.issue(t, &x509.Certificate{IssuingCertificateURL: []string{server.URL}})
+	fetch := func(ctx context.Context) *x509.Certificate {
+		return (&CertRenewal{Renewer: r, ctx: ctx, certPath: "leaf.crt", cert: leaf}).fetchIssuerViaAIA()
+	}
+
+	// A cancelled fetch says nothing about the URL.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := fetch(cancelled); got != nil {
+		t.Fatal("found an issuer with a cancelled context")
+	}
+	if _, failing := r.aiaFailingUntil(server.URL); failing {
+		t.Error("URL marked as failing after a cancelled fetch")
+	}
+
+	if got := fetch(context.Background()); got != nil || requests != 1 {
+		t.Fatalf("got %v after %d requests, want nothing after 1", got, requests)
+	}
+	broken = false
+	if got := fetch(context.Background()); got != nil || requests != 1 {
+		t.Errorf("within the failure TTL, got %v after %d requests, want nothing after 1", got, requests)
+	}
+
+	// Once the TTL is up, we try again.
+	r.aiaMutex.Lock()
+	r.aiaFailures[server.URL] = time.Now().Add(-time.Second)
+	r.aiaMutex.Unlock()
+	if got := fetch(context.Background()); got == nil || !got.Equal(ca.cert) || requests != 2 {
+		t.Errorf("after the failure TTL, got %v after %d requests, want the issuer after 2", got, requests)
+	}
+}
@@ -11,15 +11,30 @@ import (
 // BasicChecks does whatever checks the renewer library considers worthwhile
 // sanity checks to try before starting any persistent run.
 func (r *Renewer) BasicChecks() error {
-	fh, err := os.CreateTemp(r.config.OutputDir, "startup-check")
-	if err != nil {
-		return err
+	dirs := make(map[string]bool)
+	// With LayoutBeside, there's no one directory to check
+	for _, out := range r.basePolicy.outputs {
+		dirs[out.Dir] = out.Layout != LayoutBeside
 	}
-	if err = fh.Close(); err != nil {
-		return err
+	for _, b := range r.policies {
+		for _, out := range b.outputs {
+			dirs[out.Dir] = dirs[out.Dir] || out.Layout != LayoutBeside
+		}
 	}
-	if err = os.Remove(fh.Name()); err != nil {
-		return err
+	for dir, check := range dirs {
+		if !check {
+			continue
+		}
+		fh, err := os.CreateTemp(dir, "startup-check")
+		if err != nil {
+			return err
+		}
+		if err = fh.Close(); err != nil {
+			return err
+		}
+		if err = os.Remove(fh.Name()); err != nil {
+			return err
+		}
 	}
 
 	// Any other checks?
@@ -5,6 +5,7 @@
 package renew // import "go.pennock.tech/ocsprenewer/renew"
 
 import (
+	"context"
 	"crypto/x509"
 	"errors"
 	"fmt"
@@ -15,6 +16,10 @@ import (
 	"golang.org/x/crypto/ocsp"
 )
 
+// tempStaplePattern is the prefix of the temporary file a staple is written
+// to before being renamed into place.
+const tempStaplePattern = "newstaple"
+
 var (
 	ErrEmptyFilename = errors.New("derived an empty filename")
 	ErrEmptyStaple   = errors.New("staple is empty")
@@ -23,16 +28,28 @@ var (
 type CertRenewal struct {
 	*Renewer
 
-	ActionID    uint32
-	actionIDStr string
+	ActionID uint32
+
+	// for network requests; the Renewer's abandonCtx, or narrower
+	ctx context.Context
+
+	certPath    string
+	staplePath  string   // of the primary output, which we read back
+	staplePaths []string // one per policy.outputs, staplePath first
 
-	certPath   string
-	staplePath string
+	policy *certPolicy
 
 	cert, issuer *x509.Certificate
 
 	oldStapleRaw []byte
 	oldStaple    *ocsp.Response
+
+	attempted    bool           // we went to the network for a new staple
+	fetched      *ocsp.Response // what we got, whatever it said
+	newStaple    *ocsp.Response // what we got, if it was any good
+	written      bool           // we wrote (or replaced) at least one staple file
+	triedURLs    []string       // OCSP responders we tried, in order
+	responderURL string         // the OCSP responder which gave us a response
 }
 
 func certLabel(cert *x509.Certificate) string {
@@ -68,14 +85,21 @@ func (cr *CertRenewal) findStaple() error {
 		return ErrEmptyFilename
 	}
 
-	cr.staplePath = filepath.Join(cr.Renewer.config.OutputDir, fn+cr.Renewer.config.Extension)
+	cr.staplePaths = make([]string, len(cr.policy.outputs))
+	for i, out := range cr.policy.outputs {
+		sp, err := out.pathFor(cr.certPath, fn)
+		if err != nil {
+			return err
+		}
+		cr.staplePaths[i] = sp
+	}
+	cr.staplePath = cr.staplePaths[0]
 
-	// All my shell-based tooling stores in DER format, and some quick searches
-	// aren't showing anyone using PEM.  This could be a search deficiency.
-	// If you need proofs stored in PEM, submit a Pull Request (or open an Issue).
+	// All my shell-based tooling stores in DER format, which is the default;
+	// see encoders.go for the others.
 
 	var err error
-	cr.oldStapleRaw, err = os.ReadFile(cr.staplePath)
+	cr.oldStapleRaw, err = cr.readStaple()
 	if err != nil {
 		if os.IsNotExist(err) {
 			cr.CertLogAtf(1, "no existing staple at %q", cr.staplePath)
@@ -86,7 +110,30 @@ func (cr *CertRenewal) findStaple() error {
 
 	cr.CertLogAtf(1, "found existing staple at %q", cr.staplePath)
 
-	return cr.parseExistingStaple()
+	// A staple which doesn't parse, or is for some other cert (because the
+	// cert was replaced), is as good as no staple: timerMatch will want a
+	// new one.
+	if err := cr.parseExistingStaple(); err != nil {
+		cr.CertLogf("ignoring existing staple at %q: %s", cr.staplePath, err)
+		cr.oldStaple = nil
+	}
+	return nil
+}
+
+// readStaple returns the DER of the staple currently on disk in the primary
+// output, decoding it from whatever format that output is written in.
+// Errors from reading the file are returned as-is, so can be checked with
+// os.IsNotExist.
+func (cr *CertRenewal) readStaple() ([]byte, error) {
+	contents, err := os.ReadFile(cr.staplePath)
+	if err != nil {
+		return nil, err
+	}
+	der, err := cr.policy.outputs[0].format.Decode(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", cr.staplePath, err)
+	}
+	return der, nil
 }
 
 // we split this out from findStaple because we might grab the issuer later and
@@ -102,42 +149,111 @@ func (cr *CertRenewal) writeStaple(staple *ocsp.Response, rawStaple []byte) erro
 	if staple == nil {
 		return ErrEmptyStaple
 	}
+	if err := cr.checkNotRegression(staple); err != nil {
+		cr.CertLogf("keeping existing staple at %q: %s", cr.staplePath, err)
+		return err
+	}
+
+	sd := &StapleData{
+		Raw:       rawStaple,
+		Response:  staple,
+		Cert:      cr.cert,
+		SourceURL: cr.responderURL,
+	}
+
+	// Every output is attempted even if an earlier one fails, so that one
+	// broken destination doesn't starve the others; the first error wins.
+	var firstErr error
+	wroteAny := false
+	for i, out := range cr.policy.outputs {
+		wrote, err := cr.writeStapleTo(out, cr.staplePaths[i], sd)
+		if err != nil {
+			cr.CertErrorf("FAIL writing staple to %q: %s", cr.staplePaths[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if wrote {
+			wroteAny = true
+		}
+	}
+
+	if wroteAny {
+		cr.Renewer.hooks.queue(hookEvent{
+			certPath:   cr.certPath,
+			staplePath: cr.staplePath,
+			label:      cr.certLabel(),
+			outcome:    HookOutcomeRenewed,
+			hooks:      cr.policy.hooks,
+		})
+	}
+	return firstErr
+}
+
+// writeStapleTo writes the staple for one output, saying whether it did:
+// with file updates inhibited, it doesn't, and that's not an error.
+func (cr *CertRenewal) writeStapleTo(out *stapleOutput, staplePath string, sd *StapleData) (bool, error) {
+	encoded, err := out.format.Encode(sd)
+	if err != nil {
+		return false, err
+	}
+
 	if !cr.Renewer.permitFileUpdate {
-		cr.CertLogf("file update inhibited, skipping write %d bytes to %q", len(rawStaple), cr.staplePath)
-		return nil
+		cr.CertLogf("file update inhibited, skipping write %d bytes to %q", len(encoded), staplePath)
+		return false, nil
 	}
 
-	fh, err := os.CreateTemp(filepath.Dir(cr.staplePath), "newstaple")
+	if out.Layout == LayoutMirror {
+		if err := os.MkdirAll(filepath.Dir(staplePath), 0o755); err != nil {
+			return false, err
+		}
+	}
+
+	fh, err := os.CreateTemp(filepath.Dir(staplePath), tempStaplePattern)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	wrote, err := fh.Write(rawStaple)
+	wrote, err := fh.Write(encoded)
 	if err != nil {
-		return err
-	} else if wrote != len(rawStaple) {
+		_ = fh.Close()
 		_ = os.Remove(fh.Name())
-		return fmt.Errorf("%q: writing %q, only wrote %d/%d bytes", cr.certLabel(), fh.Name(), wrote, len(rawStaple))
+		return false, err
+	} else if wrote != len(encoded) {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+		return false, fmt.Errorf("%q: writing %q, only wrote %d/%d bytes", cr.certLabel(), fh.Name(), wrote, len(encoded))
 	}
 	if err := fh.Close(); err != nil {
 		_ = os.Remove(fh.Name())
-		return err
+		return false, err
 	}
 
-	fi, err := os.Stat(cr.staplePath)
-	if err == nil {
-		if err := os.Chmod(fh.Name(), fi.Mode()); err != nil {
+	mode := out.Mode
+	if mode == 0 {
+		if fi, err := os.Stat(staplePath); err == nil {
+			mode = fi.Mode()
+		}
+	}
+	if mode != 0 {
+		if err := os.Chmod(fh.Name(), mode); err != nil {
 			_ = os.Remove(fh.Name())
-			return err
+			return false, err
 		}
 	}
-	err = os.Rename(fh.Name(), cr.staplePath)
+	if out.uid != -1 || out.gid != -1 {
+		if err := os.Chown(fh.Name(), out.uid, out.gid); err != nil {
+			_ = os.Remove(fh.Name())
+			return false, err
+		}
+	}
+
+	err = os.Rename(fh.Name(), staplePath)
 	if err == nil {
-		cr.CertLogf("wrote %q (%d bytes)", cr.staplePath, wrote)
-		return nil
+		cr.written = true
+		cr.CertLogf("wrote %q (%d bytes)", staplePath, wrote)
+		return true, nil
 	}
 
 	_ = os.Remove(fh.Name())
-	cr.CertLogf("FAIL rename to %q from %q: %s", cr.staplePath, fh.Name(), err)
-	return err
+	return false, fmt.Errorf("rename from %q: %w", fh.Name(), err)
 }
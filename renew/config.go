@@ -5,9 +5,13 @@
 package renew // import "go.pennock.tech/ocsprenewer/renew"
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -18,6 +22,7 @@ type Config struct {
 	_ struct{} // we reserve right to re-order, etc, the fields here
 
 	HTTPStatus        string  // host:port listen spec
+	ControlSocket     string  // path of a Unix socket for control commands; see control.go
 	Directories       bool    // whether InputPaths denotes directories or not
 	OutputDir         string  // where to place generated OCSP staples
 	Extension         string  // filename extension to put on staples
@@ -27,6 +32,59 @@ type Config struct {
 	CertExtensions    string  // when scanning dirs, files with one of these extensions is assumed to be a cert
 	HTTPUserAgent     string  // HTTP User-Agent to send
 	InputPaths        []string
+	Watch             bool         // in persist mode with Directories, watch for changed certs
+	LogFormat         string       // how to log to stderr; see LogFormat* constants
+	LogHandler        slog.Handler // if set, log here instead of to stderr; see Renewer.SetLogHandler
+
+	Concurrency             int    // how many certs to work on at once; default 1
+	PerResponderConcurrency int    // how many requests to one OCSP responder host at once; default 1
+	ResponderOrder          string // order to try a cert's OCSP responders in; see ResponderOrder* constants
+
+	RequestMethod    string            // HTTP method for OCSP requests; see RequestMethod* constants
+	ResponderMethods map[string]string // per-responder-host override of RequestMethod
+
+	// Validation of fetched responses, before they replace the staple
+	MaxClockSkew time.Duration // how far in the future thisUpdate may be; zero for DefaultMaxClockSkew
+	MinValidity  time.Duration // shortest acceptable nextUpdate - thisUpdate
+
+	AllowStapleRegression bool // permit replacing a staple with an older or shorter-lived one
+
+	OutputFormat string // how to encode staples on disk; see Format* constants and RegisterStapleFormat
+	OutputLayout string // where staples go relative to OutputDir; see Layout* constants
+
+	Outputs []OutputSpec // where to write staples; empty for just OutputDir
+
+	// Commands run after staples are written, for servers which only reread
+	// staples on reload; see hooks.go for the environment they get
+	Hooks        []string      // each run with /bin/sh -c
+	HookDebounce time.Duration // how long to wait for further updates first; zero for DefaultHookDebounce
+	HookTimeout  time.Duration // how long a hook may run; zero for DefaultHookTimeout
+
+	Policies []CertPolicy // per-cert overrides of the settings above
+
+	StateFile       string        // in persist mode, where to keep schedule and status across restarts
+	ShutdownTimeout time.Duration // how long work in progress gets to finish at shutdown; zero for DefaultShutdownTimeout
+
+	// Retry policy after failures; see timers.go
+	TimerT2         float64       // how far through staple validity it's in danger; zero for DefaultTimerT2
+	RetryBackoffMin time.Duration // first retry interval before T2; zero for DefaultRetryBackoffMin
+	RetryBackoffMax time.Duration // longest retry interval before T2; zero for DefaultRetryBackoffMax
+	RetryInDanger   time.Duration // retry interval past T2; zero for DefaultRetryInDanger
+
+	RevocationPolicy string   // what to do with a revoked cert; see Revocation* constants
+	RevocationHooks  []string // run immediately when a cert is found revoked, with the hook environment
+
+	// Webhook notifications of trouble; see notify.go
+	WebhookURLs   []string
+	WebhookSecret string        // key to sign the JSON bodies with; empty for unsigned
+	ExpiryWarning time.Duration // notify when the staple expires within this; zero for DefaultExpiryWarning
+	NotifyRepeat  time.Duration // how soon the same problem may be notified again; zero for DefaultNotifyRepeat
+
+	// Where to look for issuers when the cert file doesn't bundle the chain
+	IssuerPaths    []string // files or directories holding CA certs
+	SystemIssuers  bool     // also search the OS trust-anchor bundle
+	FetchIssuers   bool     // as a last resort, download from the cert's AIA caIssuers URL
+	IssuerCacheDir string   // where to keep downloaded issuers; empty for memory only
 }
 
 type Renewer struct {
@@ -35,9 +93,26 @@ type Renewer struct {
 	// Modify HTTPClient if your application requires that; it defaults to http.DefaultClient
 	HTTPClient *http.Client
 
-	config    Config
-	certGlobs []string
-	logLevel  uint
+	// config and what's derived from it (certGlobs, issuers, basePolicy and
+	// policies) are replaced on reload, by applySettings with configMutex
+	// held for writing.  Goroutines other than the persist loop, which is
+	// what applies a reload, hold it for reading while they use them.
+	configMutex sync.RWMutex
+
+	config     Config
+	certGlobs  []string
+	logLevel   uint
+	logVar     slog.LevelVar // the handler level, following logLevel
+	logHandler slog.Handler  // as given to SetLogHandler
+	logger     *slog.Logger
+	issuers    *issuerStore
+	metrics    *metrics
+	hooks      *hookRunner
+	notifier   *notifier
+
+	// resolved from config; see policyFor
+	basePolicy *certPolicy
+	policies   []*policyBlock
 
 	// these are currently controlled via the -not-really flag but could be
 	// more fine-grained, thus the split.  Probably makes sense to block file
@@ -48,11 +123,41 @@ type Renewer struct {
 	// used in persist/etc modes, to indicate timers are wanted
 	needTimers bool
 
+	// when Start() was called, for status reporting
+	started time.Time
+
+	// stopCtx is cancelled by Shutdown, abandonCtx once work in progress
+	// has had its chance to finish; network requests use abandonCtx
+	stopCtx       context.Context
+	stopCancel    context.CancelFunc
+	abandonCtx    context.Context
+	abandonCancel context.CancelFunc
+	shutdownOnce  sync.Once
+
+	httpServer *http.Server
+
+	controlListener net.Listener
+	controlConns    sync.WaitGroup // control connections being served
+
 	// used in logging to have an id per action to disambiguate; manipulate with atomics
 	seqActionID uint32
 
-	// used to pass from signals that we want a sweep
-	forceSweepReqs chan sweepReq
+	// concurrency limits; responderSlots is keyed by host and protected by
+	// slotsMutex
+	workSlots            chan struct{}
+	slotsMutex           sync.Mutex
+	responderSlots       map[string]chan struct{}
+	responderConcurrency int // the size of each of responderSlots
+
+	// caIssuers URLs which recently failed us, and until when we won't try
+	// them again; protected by aiaMutex
+	aiaMutex    sync.Mutex
+	aiaFailures map[string]time.Time
+
+	// used to interrupt a sleep when there are pendingPaths, a pendingReload
+	// or a forced sweep
+	wakeup  chan struct{}
+	watcher *dirWatcher
 
 	// Everything after here protected by mutex
 
@@ -62,65 +167,201 @@ type Renewer struct {
 	// envisioned scale.
 	//
 	// If someone wants to renew thousands of certs with this tool, we can
-	// revisit this at that time.  We'd also need to renew concurrently, with
-	// concurrency limits, instead of one-at-a-time as we are currently.
+	// revisit this at that time.  Renewals themselves are concurrent, within
+	// the limits of workSlots and responderSlots.
 	renewMutex        sync.Mutex
 	nextRenew         map[string]time.Time
 	earliestNextRenew time.Time
+	certStatus        map[string]*CertStatus
 
 	forcedSweepAt time.Time
 	forcedFull    bool
+
+	// paths to be looked at soon, outside of timers
+	pendingPaths []string
+
+	// validated by Reload, to be applied by the persist loop
+	pendingReload *settings
+
+	// from the state file, for the first sweep; see resumeTimeFor
+	resumeAt map[string]time.Time
+
+	// only touched by the main loop
+	lastSavedState []byte
+}
+
+// settings is a validated Config with what's derived from it: everything
+// which a reload replaces.
+type settings struct {
+	config     Config
+	certGlobs  []string
+	basePolicy *certPolicy
+	policies   []*policyBlock
+	issuers    *issuerStore
 }
 
 func New(c Config) (*Renewer, error) {
 	r := Renewer{
-		config:            c,
 		nextRenew:         make(map[string]time.Time),
+		certStatus:        make(map[string]*CertStatus),
+		aiaFailures:       make(map[string]time.Time),
+		metrics:           newMetrics(),
 		permitRemoteComms: true,
 		permitFileUpdate:  true,
 		HTTPClient:        http.DefaultClient,
 		seqActionID:       seedActionID(),
-		forceSweepReqs:    make(chan sweepReq, 3),
+		wakeup:            make(chan struct{}, 1),
+	}
+	r.stopCtx, r.stopCancel = context.WithCancel(context.Background())
+	r.abandonCtx, r.abandonCancel = context.WithCancel(context.Background())
+
+	var err error
+	h := c.LogHandler
+	if h == nil {
+		h, err = NewLogHandler(os.Stderr, c.LogFormat, &slog.HandlerOptions{Level: &r.logVar})
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.SetLogHandler(h)
+
+	s, err := r.newSettings(c)
+	if err != nil {
+		return nil, err
 	}
+	r.hooks = newHookRunner(&r)
+	r.notifier = newNotifier(&r)
+	r.applySettings(s)
+
+	return &r, nil
+}
+
+// newSettings validates c, filling in defaults, and resolves what's derived
+// from it.  Nothing in r is changed.
+func (r *Renewer) newSettings(c Config) (*settings, error) {
+	s := &settings{config: c}
+	var err error
 
-	if r.config.HTTPUserAgent == "" {
+	if s.config.HTTPUserAgent == "" {
 		return nil, errors.New("you must take accountability with an HTTP User-Agent")
 	}
 
-	if len(r.config.InputPaths) == 0 {
+	if len(s.config.InputPaths) == 0 {
 		return nil, errors.New("no input paths to examine")
 	}
 
-	if 1 <= r.config.TimerT1 && r.config.TimerT1 <= 100 {
-		// Handle percentages on cmdline, instead of ratios
-		r.config.TimerT1 = r.config.TimerT1 / 100.0
+	if s.config.TimerT1, err = normaliseTimerT1(s.config.TimerT1); err != nil {
+		return nil, err
 	}
-	if r.config.TimerT1 < 0.1 {
-		return nil, errors.New("timer T1 set too small (10% minimum)")
+	if 1 <= s.config.TimerT2 && s.config.TimerT2 <= 100 {
+		s.config.TimerT2 = s.config.TimerT2 / 100.0
 	}
-	if r.config.TimerT1 > 0.95 {
-		return nil, errors.New("timer T1 set too large (95% maximum)")
+	if t2 := effectiveTimerT2(s.config.TimerT2); t2 <= s.config.TimerT1 || t2 >= 1 {
+		return nil, fmt.Errorf("timer T2 (%v) must be after T1 (%v) and before expiry", t2, s.config.TimerT1)
+	}
+	if s.config.RetryBackoffMin < 0 || s.config.RetryBackoffMax < 0 || s.config.RetryInDanger < 0 {
+		return nil, errors.New("retry durations must not be negative")
 	}
 
-	if !directoryExists(r.config.OutputDir) {
-		return nil, fmt.Errorf("output directory %q does not exist or is not a directory", r.config.OutputDir)
+	switch s.config.ResponderOrder {
+	case "":
+		s.config.ResponderOrder = ResponderOrderListed
+	case ResponderOrderListed, ResponderOrderRandom, ResponderOrderLastGood:
+	default:
+		return nil, fmt.Errorf("unknown responder order %q", s.config.ResponderOrder)
 	}
 
-	for _, e := range strings.Fields(r.config.CertExtensions) {
-		r.certGlobs = append(r.certGlobs, "*"+e)
+	if s.config.RequestMethod == "" {
+		s.config.RequestMethod = RequestMethodAuto
+	}
+	if err := checkRequestMethod(s.config.RequestMethod); err != nil {
+		return nil, err
 	}
-	if r.certGlobs == nil {
-		r.certGlobs = []string{"*.crt"}
+	for host, m := range s.config.ResponderMethods {
+		if err := checkRequestMethod(m); err != nil {
+			return nil, fmt.Errorf("responder %q: %w", host, err)
+		}
 	}
 
-	return &r, nil
+	if s.config.MaxClockSkew < 0 || s.config.MinValidity < 0 {
+		return nil, errors.New("validation durations must not be negative")
+	}
+	if s.config.RevocationPolicy == "" {
+		s.config.RevocationPolicy = RevocationKeep
+	}
+	if err := checkRevocationPolicy(s.config.RevocationPolicy); err != nil {
+		return nil, err
+	}
+
+	if s.config.ShutdownTimeout < 0 {
+		return nil, errors.New("shutdown timeout must not be negative")
+	}
+
+	if s.config.HookDebounce < 0 || s.config.HookTimeout < 0 {
+		return nil, errors.New("hook durations must not be negative")
+	}
+
+	if s.config.ExpiryWarning < 0 || s.config.NotifyRepeat < 0 {
+		return nil, errors.New("notification durations must not be negative")
+	}
+
+	if s.config.Concurrency < 1 {
+		s.config.Concurrency = 1
+	}
+	if s.config.PerResponderConcurrency < 1 {
+		s.config.PerResponderConcurrency = 1
+	}
+
+	if err := s.resolvePolicies(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range strings.Fields(s.config.CertExtensions) {
+		s.certGlobs = append(s.certGlobs, "*"+e)
+	}
+	if s.certGlobs == nil {
+		s.certGlobs = []string{"*.crt"}
+	}
+
+	if s.issuers, err = r.loadIssuers(s.config); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// applySettings makes s current.  The concurrency limits are only replaced
+// if they change: work in progress releases its slots to the old ones.
+func (r *Renewer) applySettings(s *settings) {
+	r.configMutex.Lock()
+	defer r.configMutex.Unlock()
+
+	r.config = s.config
+	r.certGlobs = s.certGlobs
+	r.basePolicy = s.basePolicy
+	r.policies = s.policies
+	r.issuers = s.issuers
+	r.hooks.setTimes(s.config)
+
+	if cap(r.workSlots) != s.config.Concurrency {
+		r.workSlots = make(chan struct{}, s.config.Concurrency)
+	}
+	r.slotsMutex.Lock()
+	if r.responderSlots == nil || r.responderConcurrency != s.config.PerResponderConcurrency {
+		r.responderSlots = make(map[string]chan struct{})
+		r.responderConcurrency = s.config.PerResponderConcurrency
+	}
+	r.slotsMutex.Unlock()
 }
 
 func (r *Renewer) SetLogLevel(lvl uint) {
 	r.logLevel = lvl
+	r.logVar.Set(VerbosityLevel(lvl))
 }
 
 func (r *Renewer) SetImmediate(i bool) error {
+	r.configMutex.Lock()
+	defer r.configMutex.Unlock()
 	r.config.Immediate = i
 	return nil
 }
@@ -150,3 +391,45 @@ func (r *Renewer) httpDo(req *http.Request) (*http.Response, error) {
 	req.Header.Set("User-Agent", r.config.HTTPUserAgent)
 	return r.HTTPClient.Do(req)
 }
+
+// acquireResponderSlot blocks until we're allowed to talk to the responder,
+// returning the function to call when done, or until ctx is done.
+func (r *Renewer) acquireResponderSlot(ctx context.Context, responderURL string) (release func(), err error) {
+	host := responderHost(responderURL)
+	r.slotsMutex.Lock()
+	slots, ok := r.responderSlots[host]
+	if !ok {
+		slots = make(chan struct{}, r.responderConcurrency)
+		r.responderSlots[host] = slots
+	}
+	r.slotsMutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func checkRequestMethod(m string) error {
+	switch m {
+	case RequestMethodAuto, RequestMethodGet, RequestMethodPost:
+		return nil
+	}
+	return fmt.Errorf("unknown OCSP request method %q", m)
+}
+
+func (r *Renewer) requestMethodFor(responderURL string) string {
+	if m, ok := r.config.ResponderMethods[responderHost(responderURL)]; ok {
+		return m
+	}
+	return r.config.RequestMethod
+}
+
+func responderHost(responderURL string) string {
+	if u, err := url.Parse(responderURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return responderURL
+}
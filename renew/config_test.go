@@ -0,0 +1,41 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// newTestRenewer calls New with c, first filling in what New insists on: an
+// input directory and an output directory, both empty, and so on.  Logging is
+// discarded.
+func newTestRenewer(t *testing.T, c Config) *Renewer {
+	t.Helper()
+	if c.HTTPUserAgent == "" {
+		c.HTTPUserAgent = "ocsprenewer-test"
+	}
+	if c.InputPaths == nil {
+		c.InputPaths = []string{t.TempDir()}
+	}
+	if c.OutputDir == "" {
+		c.OutputDir = t.TempDir()
+	}
+	if c.Extension == "" {
+		c.Extension = ".ocsp"
+	}
+	if c.LogHandler == nil {
+		c.LogHandler = slog.NewTextHandler(io.Discard, nil)
+	}
+	if c.TimerT1 == 0 {
+		c.TimerT1 = 0.5
+	}
+	r, err := New(c)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	return r
+}
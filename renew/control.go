@@ -0,0 +1,294 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Values for ControlRequest.Command
+const (
+	ControlStatus = "status" // summary plus all tracked certs
+	ControlRenew  = "renew"  // renew the cert at Args[0] now, replying when done
+	ControlSweep  = "sweep"  // queue a sweep, ignoring timers if Full
+	ControlForget = "forget" // stop tracking the cert at Args[0]
+	ControlNext   = "next"   // the scheduled checks, soonest first
+)
+
+// How long a control client has to send its request; a renew can take
+// however long the fetch does before we reply.
+const controlReadTimeout = 10 * time.Second
+
+// ControlRequest is sent, as one line of JSON, to Config.ControlSocket.
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Dir     string   `json:"dir,omitempty"`  // the client's working directory, for relative paths in Args
+	Full    bool     `json:"full,omitempty"` // for ControlSweep
+}
+
+// ControlResponse is the JSON reply to a ControlRequest, after which the
+// connection is closed.  For ControlRenew, OK says whether the renewal
+// succeeded, and Cert is filled in either way if the cert is tracked.
+type ControlResponse struct {
+	OK      bool             `json:"ok"`
+	Error   string           `json:"error,omitempty"`
+	Message string           `json:"message,omitempty"`
+	Status  *StatusSummary   `json:"status,omitempty"`
+	Cert    *CertStatus      `json:"cert,omitempty"`
+	Next    []ScheduledCheck `json:"next,omitempty"`
+}
+
+// ScheduledCheck is one entry in the reply to ControlNext.
+type ScheduledCheck struct {
+	Path string    `json:"path"`
+	At   time.Time `json:"at"`
+}
+
+// startControlSocket binds the socket synchronously, as for the HTTP status
+// service, then serves in the background.  The socket is only accessible to
+// our own user.
+func (r *Renewer) startControlSocket() error {
+	if r.config.ControlSocket == "" {
+		return nil
+	}
+	if err := removeStaleSocket(r.config.ControlSocket); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", r.config.ControlSocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(r.config.ControlSocket, 0o600); err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	r.Logf("control socket listening on %q", r.config.ControlSocket)
+	r.controlListener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !r.stopping() {
+					r.Errorf("control socket exited: %s", err)
+				}
+				return
+			}
+			r.controlConns.Add(1)
+			go r.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+// removeStaleSocket removes a socket left behind by a previous run, but not
+// one which something is still listening on, nor anything not a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("control socket %q exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("control socket %q is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func (r *Renewer) serveControl(conn net.Conn) {
+	defer r.controlConns.Done()
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(controlReadTimeout))
+	line, err := bufio.NewReader(io.LimitReader(conn, 64*1024)).ReadBytes('\n')
+	if err != nil && !(err == io.EOF && len(line) > 0) {
+		r.Warnf("control socket: reading request: %s", err)
+		return
+	}
+	var req ControlRequest
+	var resp ControlResponse
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = "malformed request: " + err.Error()
+	} else {
+		r.LogAtf(1, "control socket: %s %q", req.Command, req.Args)
+		r.configMutex.RLock()
+		resp = r.control(req)
+		r.configMutex.RUnlock()
+	}
+
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+func (r *Renewer) control(req ControlRequest) ControlResponse {
+	var resp ControlResponse
+	wantArgs := 0
+	switch req.Command {
+	case ControlRenew, ControlForget:
+		wantArgs = 1
+	case ControlStatus, ControlSweep, ControlNext:
+	default:
+		resp.Error = fmt.Sprintf("unknown command %q", req.Command)
+		return resp
+	}
+	if len(req.Args) != wantArgs {
+		resp.Error = fmt.Sprintf("%s: expected %d arguments, got %d", req.Command, wantArgs, len(req.Args))
+		return resp
+	}
+
+	switch req.Command {
+	case ControlStatus:
+		st := r.statusSummary()
+		resp.Status = &st
+
+	case ControlRenew:
+		p, known := r.controlPath(req.Dir, req.Args[0])
+		if !known {
+			resp.Error = fmt.Sprintf("%q is not under any input path", p)
+			return resp
+		}
+		r.Logf("control socket: renewing %q", p)
+		result, err := r.controlRenew(p)
+		if st, ok := r.certStatusOf(p); ok {
+			resp.Cert = &st
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		if result.Written {
+			resp.Message = "renewed, staple written to " + result.StaplePath
+		} else {
+			resp.Message = "renewed, no staple written"
+		}
+
+	case ControlSweep:
+		r.Logf("control socket: triggering forced renew (full=%v)", req.Full)
+		r.ForceCheckSoon(req.Full)
+		resp.Message = "sweep queued"
+
+	case ControlForget:
+		if p, _ := r.controlPath(req.Dir, req.Args[0]); !r.forgetPath(p) {
+			resp.Error = fmt.Sprintf("%q is not tracked", req.Args[0])
+			return resp
+		}
+		resp.Message = "forgotten until next found by a sweep or directory watch"
+
+	case ControlNext:
+		timePaths := r.getTimePaths()
+		sort.Slice(timePaths, func(i, j int) bool { return timePaths[i].T.Before(timePaths[j].T) })
+		resp.Next = make([]ScheduledCheck, len(timePaths))
+		for i := range timePaths {
+			resp.Next[i] = ScheduledCheck{Path: timePaths[i].P, At: timePaths[i].T}
+		}
+	}
+
+	resp.OK = true
+	return resp
+}
+
+// controlPath gives the path by which we know the cert which a client named
+// as p, relative to its working directory dir: we compare them as absolute
+// paths with symlinks resolved.  That's the path we track it by, else the
+// one a sweep of the input paths would find it by.  If it's neither, we
+// return p made absolute, and false.
+func (r *Renewer) controlPath(dir, p string) (string, bool) {
+	if !filepath.IsAbs(p) && dir != "" {
+		p = filepath.Join(dir, p)
+	}
+	want := canonicalPath(p)
+	for _, tracked := range r.trackedPaths() {
+		if tracked == p || canonicalPath(tracked) == want {
+			return tracked, true
+		}
+	}
+	for _, in := range r.config.InputPaths {
+		if r.config.Directories {
+			candidate := filepath.Join(in, filepath.Base(p))
+			if canonicalPath(candidate) == want && r.coveredByInputs(candidate) {
+				return candidate, true
+			}
+		} else if canonicalPath(in) == want {
+			return in, true
+		}
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs, false
+	}
+	return p, false
+}
+
+// canonicalPath makes p absolute and resolves symlinks, as far as it can.
+func canonicalPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	return p
+}
+
+// controlRenew renews the cert at p now, ignoring timers.  Only certs which
+// we'd find anyway are renewed, so that clients can't have us write staples
+// for, and keep checking, arbitrary files.
+func (r *Renewer) controlRenew(p string) (*RenewResult, error) {
+	if !r.coveredByInputs(p) {
+		return nil, fmt.Errorf("not under any input path: %q", p)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file: %q", p)
+	}
+	return r.renewPath(r.abandonCtx, p)
+}
+
+// ControlCall sends req to the control socket at socketPath and returns the
+// reply.  A reply with OK false is not an error here.
+func ControlCall(socketPath string, req ControlRequest, timeout time.Duration) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(body, '\n')); err != nil {
+		return nil, err
+	}
+
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("control socket closed without replying")
+		}
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startControlled runs a persistent renewer over dir with a control socket,
+// returning once the first sweep has scheduled every cert in dir.
+func startControlled(t *testing.T, dir string) (*Renewer, string) {
+	t.Helper()
+	// Not t.TempDir(): socket paths have a short length limit.
+	sockDir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(sockDir) })
+	sock := filepath.Join(sockDir, "control")
+
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{dir}, ControlSocket: sock})
+	done := make(chan bool)
+	go func() { done <- r.Start() }()
+	t.Cleanup(func() {
+		r.Shutdown()
+		<-done
+	})
+
+	want, _ := filepath.Glob(filepath.Join(dir, "*.crt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := ControlCall(sock, ControlRequest{Command: ControlNext}, time.Second)
+		if err == nil && len(resp.Next) == len(want) {
+			return r, sock
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first sweep not done: %+v, %v", resp, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	dir := t.TempDir()
+	leafPath, leaf := ca.writeLeaf(t, dir, "leaf.crt", responder.URL)
+	_, sock := startControlled(t, dir)
+
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket %v (%v), want mode 0600", fi, err)
+	}
+
+	call := func(req ControlRequest) *ControlResponse {
+		t.Helper()
+		resp, err := ControlCall(sock, req, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", req.Command, err)
+		}
+		return resp
+	}
+
+	resp := call(ControlRequest{Command: ControlStatus})
+	if !resp.OK || resp.Status == nil || len(resp.Status.Certs) != 1 || resp.Status.Certs[0].Path != leafPath {
+		t.Errorf("status: got %+v", resp)
+	}
+
+	requestsBefore, _ := responder.counts()
+	resp = call(ControlRequest{Command: ControlRenew, Args: []string{leafPath}})
+	if !resp.OK || resp.Cert == nil || resp.Cert.Serial != leaf.SerialNumber.Text(16) || resp.Cert.LastResult != ResultRenewed {
+		t.Errorf("renew: got %+v, cert %+v", resp, resp.Cert)
+	}
+	if requests, _ := responder.counts(); requests != requestsBefore+1 {
+		t.Errorf("renew made %d OCSP requests, want 1", requests-requestsBefore)
+	}
+
+	resp = call(ControlRequest{Command: ControlForget, Args: []string{leafPath}})
+	if !resp.OK {
+		t.Errorf("forget: got %+v", resp)
+	}
+	if resp = call(ControlRequest{Command: ControlForget, Args: []string{leafPath}}); resp.OK || !strings.Contains(resp.Error, "not tracked") {
+		t.Errorf("forget again: got %+v", resp)
+	}
+
+	resp = call(ControlRequest{Command: ControlSweep, Full: true})
+	if !resp.OK || resp.Message == "" {
+		t.Errorf("sweep: got %+v", resp)
+	}
+
+	for _, req := range []ControlRequest{
+		{Command: "reboot"},
+		{Command: ControlRenew},
+		{Command: ControlStatus, Args: []string{"extra"}},
+		{Command: ControlRenew, Args: []string{filepath.Join(dir, "missing.crt")}},
+	} {
+		if resp := call(req); resp.OK || resp.Error == "" {
+			t.Errorf("%s %q: got %+v, want an error", req.Command, req.Args, resp)
+		}
+	}
+}
+
+func TestControlSocketMalformed(t *testing.T) {
+	_, sock := startControlled(t, t.TempDir())
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("status please\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ControlResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("reply %q: %s", line, err)
+	}
+	if resp.OK || !strings.HasPrefix(resp.Error, "malformed request") {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	if err := removeStaleSocket(filepath.Join(dir, "absent")); err != nil {
+		t.Errorf("absent: %s", err)
+	}
+
+	plain := filepath.Join(dir, "plain")
+	touch(t, plain)
+	if err := removeStaleSocket(plain); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("plain file: got %v", err)
+	}
+
+	live := filepath.Join(dir, "live")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(live); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("live socket: got %v", err)
+	}
+
+	// Closing a unix listener unlinks its socket; make a stale one as a
+	// crashed process would leave.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	if err := removeStaleSocket(live); err != nil {
+		t.Errorf("stale socket: %s", err)
+	}
+	if _, err := os.Lstat(live); !os.IsNotExist(err) {
+		t.Errorf("stale socket not removed: %v", err)
+	}
+}
+
+func TestControlPath(t *testing.T) {
+	dir := t.TempDir()
+	certs := filepath.Join(dir, "certs")
+	tracked := filepath.Join(certs, "leaf.crt")
+	untracked := filepath.Join(certs, "other.crt")
+	outside := filepath.Join(dir, "outside.crt")
+	if err := os.Mkdir(certs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tracked, untracked, outside)
+	if err := os.Symlink("certs", filepath.Join(dir, "live")); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{certs}})
+	r.needTimers = true
+	r.RegisterFutureCheck(tracked, time.Now().Add(time.Hour))
+
+	for _, tc := range []struct {
+		dir, p string
+		want   string
+		known  bool
+	}{
+		{"", tracked, tracked, true},
+		{"/elsewhere", tracked, tracked, true},
+		{dir, "certs/leaf.crt", tracked, true},
+		{certs, "leaf.crt", tracked, true},
+		{dir, "live/leaf.crt", tracked, true},
+		{certs, "../live/./leaf.crt", tracked, true},
+		{dir, "live/other.crt", untracked, true},
+		{dir, "certs/missing.crt", filepath.Join(certs, "missing.crt"), true},
+		{dir, "outside.crt", outside, false},
+		{certs, "../outside.crt", outside, false},
+	} {
+		if got, known := r.controlPath(tc.dir, tc.p); got != tc.want || known != tc.known {
+			t.Errorf("controlPath(%q, %q) = %q, %v; want %q, %v", tc.dir, tc.p, got, known, tc.want, tc.known)
+		}
+	}
+
+	// A client mustn't be able to have us write a staple for any old cert.
+	resp := r.control(ControlRequest{Command: ControlRenew, Args: []string{"../outside.crt"}, Dir: certs})
+	if resp.OK || !strings.Contains(resp.Error, "not under any input path") {
+		t.Errorf("renew outside the inputs: got %+v", resp)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Names of the built-in staple formats
+const (
+	FormatDER    = "der"
+	FormatPEM    = "pem"
+	FormatBase64 = "base64"
+	FormatJSON   = "json"
+)
+
+// PEMTypeOCSPResponse is the PEM block type used for FormatPEM
+const PEMTypeOCSPResponse = "OCSP RESPONSE"
+
+var (
+	ErrStapleDecode = errors.New("unable to decode staple from file")
+)
+
+// StapleData is what a StapleFormat is given to encode.
+type StapleData struct {
+	Raw       []byte // the DER OCSP response, as received
+	Response  *ocsp.Response
+	Cert      *x509.Certificate
+	SourceURL string // the OCSP responder it came from
+}
+
+// StapleFormat converts between a DER OCSP response and the form in which it
+// is stored on disk.  We need to decode too, to know what we already have.
+type StapleFormat interface {
+	Encode(*StapleData) ([]byte, error)
+	Decode(fileContents []byte) (der []byte, err error)
+}
+
+// Not protected by a mutex: register any extra formats before calling New.
+var stapleFormats = map[string]StapleFormat{
+	FormatDER:    derFormat{},
+	FormatPEM:    pemFormat{},
+	FormatBase64: base64Format{},
+	FormatJSON:   jsonFormat{},
+}
+
+// RegisterStapleFormat adds a staple format which can then be named in
+// configuration.  It must be called before New.
+func RegisterStapleFormat(name string, f StapleFormat) {
+	stapleFormats[name] = f
+}
+
+// LookupStapleFormat finds a staple format by name; the empty name is DER.
+func LookupStapleFormat(name string) (StapleFormat, error) {
+	if name == "" {
+		name = FormatDER
+	}
+	if f, ok := stapleFormats[name]; ok {
+		return f, nil
+	}
+	known := make([]string, 0, len(stapleFormats))
+	for k := range stapleFormats {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	return nil, fmt.Errorf("unknown staple format %q (known: %q)", name, known)
+}
+
+// derFormat is what most servers (Exim, HAProxy) want, and our default.
+type derFormat struct{}
+
+func (derFormat) Encode(sd *StapleData) ([]byte, error) { return sd.Raw, nil }
+func (derFormat) Decode(b []byte) ([]byte, error)       { return b, nil }
+
+type pemFormat struct{}
+
+func (pemFormat) Encode(sd *StapleData) ([]byte, error) {
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeOCSPResponse, Bytes: sd.Raw}), nil
+}
+
+func (pemFormat) Decode(b []byte) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != PEMTypeOCSPResponse {
+		return nil, ErrStapleDecode
+	}
+	return block.Bytes, nil
+}
+
+// base64Format is one line of standard base64, newline-terminated.
+type base64Format struct{}
+
+func (base64Format) Encode(sd *StapleData) ([]byte, error) {
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sd.Raw)), base64.StdEncoding.EncodedLen(len(sd.Raw))+1)
+	base64.StdEncoding.Encode(out, sd.Raw)
+	return append(out, '\n'), nil
+}
+
+func (base64Format) Decode(b []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+}
+
+// StapleJSON is the document written by the "json" staple format.
+type StapleJSON struct {
+	Serial     string    `json:"serial"`
+	Status     string    `json:"status"`
+	ProducedAt time.Time `json:"produced_at"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	SourceURL  string    `json:"source_url"`
+	Response   []byte    `json:"response"` // DER, base64 in the JSON
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Encode(sd *StapleData) ([]byte, error) {
+	doc := StapleJSON{
+		Serial:     sd.Response.SerialNumber.Text(16),
+		Status:     ocspStatusName(sd.Response.Status),
+		ProducedAt: sd.Response.ProducedAt,
+		ThisUpdate: sd.Response.ThisUpdate,
+		NextUpdate: sd.Response.NextUpdate,
+		SourceURL:  sd.SourceURL,
+		Response:   sd.Raw,
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func (jsonFormat) Decode(b []byte) ([]byte, error) {
+	var doc StapleJSON
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Response) == 0 {
+		return nil, ErrStapleDecode
+	}
+	return doc.Response, nil
+}
+
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("status-%d", status)
+}
@@ -0,0 +1,110 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestStapleFormatsRoundTrip(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	now := time.Now().Truncate(time.Second)
+	raw := ca.ocspResponse(&ocsp.Request{SerialNumber: leaf.SerialNumber}, ocsp.Response{Status: ocsp.Good, ThisUpdate: now, NextUpdate: now.Add(time.Hour)})
+	staple, err := ocsp.ParseResponseForCert(raw, leaf, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &StapleData{Raw: raw, Response: staple, Cert: leaf, SourceURL: "http://ocsp.example/"}
+
+	for _, tc := range []struct {
+		format string
+		check  func(encoded []byte) bool // what the encoded form looks like
+	}{
+		{"", func(b []byte) bool { return bytes.Equal(b, raw) }},
+		{FormatDER, func(b []byte) bool { return bytes.Equal(b, raw) }},
+		{FormatPEM, func(b []byte) bool { return bytes.HasPrefix(b, []byte("-----BEGIN OCSP RESPONSE-----\n")) }},
+		{FormatBase64, func(b []byte) bool { return bytes.Count(b, []byte("\n")) == 1 && b[len(b)-1] == '\n' }},
+		{FormatJSON, func(b []byte) bool {
+			var doc StapleJSON
+			return json.Unmarshal(b, &doc) == nil &&
+				doc.Status == "good" &&
+				doc.Serial == leaf.SerialNumber.Text(16) &&
+				doc.NextUpdate.Equal(now.Add(time.Hour)) &&
+				doc.SourceURL == sd.SourceURL
+		}},
+	} {
+		f, err := LookupStapleFormat(tc.format)
+		if err != nil {
+			t.Fatalf("format %q: %s", tc.format, err)
+		}
+		encoded, err := f.Encode(sd)
+		if err != nil {
+			t.Fatalf("format %q: encoding: %s", tc.format, err)
+		}
+		if !tc.check(encoded) {
+			t.Errorf("format %q: unexpected encoding %q", tc.format, encoded)
+		}
+		der, err := f.Decode(encoded)
+		if err != nil {
+			t.Fatalf("format %q: decoding: %s", tc.format, err)
+		}
+		if !bytes.Equal(der, raw) {
+			t.Errorf("format %q: round trip changed the staple", tc.format)
+		}
+
+		// and what findStaple reads back off disk
+		r := newTestRenewer(t, Config{OutputFormat: tc.format})
+		cr := &CertRenewal{Renewer: r, policy: r.basePolicy, staplePath: filepath.Join(t.TempDir(), "leaf.crt.ocsp")}
+		if err := os.WriteFile(cr.staplePath, encoded, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if der, err := cr.readStaple(); err != nil || !bytes.Equal(der, raw) {
+			t.Errorf("format %q: readStaple gave error %v, matching %v", tc.format, err, bytes.Equal(der, raw))
+		}
+	}
+
+	for format, junk := range map[string]string{
+		FormatPEM:    "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n",
+		FormatBase64: "not base64!\n",
+		FormatJSON:   `{"status": "good"}`,
+	} {
+		f, _ := LookupStapleFormat(format)
+		if _, err := f.Decode([]byte(junk)); err == nil {
+			t.Errorf("format %q decoded %q", format, junk)
+		}
+	}
+}
+
+type hexFormat struct{}
+
+func (hexFormat) Encode(sd *StapleData) ([]byte, error) {
+	return []byte(hex.EncodeToString(sd.Raw)), nil
+}
+func (hexFormat) Decode(b []byte) ([]byte, error) { return hex.DecodeString(string(b)) }
+
+func TestRegisterStapleFormat(t *testing.T) {
+	if _, err := LookupStapleFormat("hex-test"); err == nil || !strings.Contains(err.Error(), `"hex-test"`) {
+		t.Errorf("looking up an unregistered format: got %v", err)
+	}
+
+	RegisterStapleFormat("hex-test", hexFormat{})
+	defer delete(stapleFormats, "hex-test")
+
+	r := newTestRenewer(t, Config{OutputFormat: "hex-test"})
+	if _, ok := r.basePolicy.outputs[0].format.(hexFormat); !ok {
+		t.Errorf("renewer uses %T, want the registered hexFormat", r.basePolicy.outputs[0].format)
+	}
+}
@@ -13,6 +13,7 @@ import (
 type RevokedError struct {
 	Cert      *x509.Certificate
 	RevokedAt time.Time
+	Reason    int // per RFC 5280 CRLReason; see ocsp.Unspecified etc
 }
 
 func (re RevokedError) Error() string {
@@ -20,10 +21,30 @@ func (re RevokedError) Error() string {
 }
 
 type UnknownAtCAError struct {
-	Cert *x509.Certificate
-	URL  string
+	Cert  *x509.Certificate
+	URL   string   // the responder which said "unknown"
+	Tried []string // every responder we tried, in order, including URL
 }
 
 func (uace UnknownAtCAError) Error() string {
+	if len(uace.Tried) > 1 {
+		return fmt.Sprintf("Cert %q not recognized as issued by OCSP responder at %q (tried %q)", certLabel(uace.Cert), uace.URL, uace.Tried)
+	}
 	return fmt.Sprintf("Cert %q not recognized as issued by OCSP responder at %q", certLabel(uace.Cert), uace.URL)
 }
+
+// RejectedStapleError is returned when a fetched response fails validation
+// and so was not installed; Reason is one of the ErrThisUpdateInFuture family.
+type RejectedStapleError struct {
+	Cert   *x509.Certificate
+	Reason error
+	Detail string
+}
+
+func (rse RejectedStapleError) Error() string {
+	return fmt.Sprintf("Cert %q: rejected OCSP response: %s: %s", certLabel(rse.Cert), rse.Reason, rse.Detail)
+}
+
+func (rse RejectedStapleError) Unwrap() error {
+	return rse.Reason
+}
@@ -13,16 +13,19 @@ type sweepReq struct {
 	Full bool
 }
 
-// We can be interrupted by a forced full sweep; if so, then we set
-// forcedSweepAt to persist in the renewer object that this has happened, to
-// make it easier to decide later what should happen.
+// We can be interrupted by a forced sweep, which ForceCheckSoon has recorded
+// in forcedSweepAt, by paths queued by the watcher, or by a pending reload.
 func (r *Renewer) sleepUnlessInterrupted(dur time.Duration) {
 	sleeper := time.NewTimer(dur)
 	select {
 	case <-sleeper.C:
 		return
-	case req := <-r.forceSweepReqs:
-		r.forceAddCheck(req)
+	case <-r.wakeup:
+		if !sleeper.Stop() {
+			<-sleeper.C
+		}
+		return
+	case <-r.stopCtx.Done():
 		if !sleeper.Stop() {
 			<-sleeper.C
 		}
@@ -30,9 +33,15 @@ func (r *Renewer) sleepUnlessInterrupted(dur time.Duration) {
 	}
 }
 
-// Interrupt the current sleep, force a sweep soon.
+// Interrupt the current sleep, force a sweep soon.  This never blocks: the
+// request is recorded for the persist loop to pick up, coalescing with any
+// already waiting.
 func (r *Renewer) ForceCheckSoon(full bool) {
-	r.forceSweepReqs <- sweepReq{T: time.Now(), Full: full}
+	r.forceAddCheck(sweepReq{T: time.Now(), Full: full})
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
 }
 
 // If a sweep has been requested, return the time/identity for that.
@@ -0,0 +1,238 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hook timing defaults, used when the Config fields are zero.
+const (
+	DefaultHookDebounce = 5 * time.Second
+	DefaultHookTimeout  = 30 * time.Second
+	// However busy things are, a batch is not held back longer than this.
+	HookMaxDelay = 5 * time.Minute
+)
+
+// Values for OCSPRENEWER_OUTCOME
+const (
+	HookOutcomeRenewed = "renewed"
+)
+
+// hookEvent is one staple update which hooks should hear about.
+type hookEvent struct {
+	certPath   string
+	staplePath string
+	label      string
+	outcome    string
+	hooks      []string // per the cert's policy
+}
+
+// hookRunner batches staple updates and runs the configured hooks once per
+// batch, after things have been quiet for the debounce interval: a sweep
+// which renews 40 staples should reload the consuming server once.
+type hookRunner struct {
+	r *Renewer
+
+	mu         sync.Mutex
+	pending    []hookEvent
+	firstQueue time.Time
+	timer      *time.Timer
+
+	// held while hooks run, so that batches don't overlap
+	runMutex sync.Mutex
+
+	// from the Config, kept here since fire runs outside any sweep; see
+	// setTimes
+	debounceTime atomic.Int64
+	timeoutTime  atomic.Int64
+}
+
+func newHookRunner(r *Renewer) *hookRunner {
+	return &hookRunner{r: r}
+}
+
+// setTimes takes the hook timings from c, applying defaults.
+func (h *hookRunner) setTimes(c Config) {
+	debounce, timeout := c.HookDebounce, c.HookTimeout
+	if debounce <= 0 {
+		debounce = DefaultHookDebounce
+	}
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	h.debounceTime.Store(int64(debounce))
+	h.timeoutTime.Store(int64(timeout))
+}
+
+func (h *hookRunner) debounce() time.Duration {
+	return time.Duration(h.debounceTime.Load())
+}
+
+func (h *hookRunner) timeout() time.Duration {
+	return time.Duration(h.timeoutTime.Load())
+}
+
+func (h *hookRunner) queue(ev hookEvent) {
+	if len(ev.hooks) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if len(h.pending) == 0 {
+		h.firstQueue = now
+	}
+	h.pending = append(h.pending, ev)
+
+	delay := h.debounce()
+	if limit := h.firstQueue.Add(HookMaxDelay); now.Add(delay).After(limit) {
+		delay = limit.Sub(now)
+	}
+	if h.timer == nil {
+		h.timer = time.AfterFunc(delay, h.fire)
+	} else {
+		h.timer.Reset(delay)
+	}
+}
+
+func (h *hookRunner) takePending() []hookEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	batch := h.pending
+	h.pending = nil
+	return batch
+}
+
+func (h *hookRunner) fire() {
+	h.runMutex.Lock()
+	defer h.runMutex.Unlock()
+	batch := h.takePending()
+	if len(batch) == 0 {
+		return
+	}
+
+	// Certs can have different hooks, so each hook is run once, told about
+	// just the updates which wanted it.
+	var commands []string
+	wanted := make(map[string][]hookEvent)
+	for _, ev := range batch {
+		for _, command := range ev.hooks {
+			if _, ok := wanted[command]; !ok {
+				commands = append(commands, command)
+			}
+			wanted[command] = append(wanted[command], ev)
+		}
+	}
+	for _, command := range commands {
+		h.runOne(command, wanted[command])
+	}
+}
+
+// runNow runs the hooks in ev immediately, rather than batching, with extra
+// environment variables.
+func (h *hookRunner) runNow(ev hookEvent, extraEnv ...string) {
+	h.runMutex.Lock()
+	defer h.runMutex.Unlock()
+	for _, command := range ev.hooks {
+		h.runOne(command, []hookEvent{ev}, extraEnv...)
+	}
+}
+
+// FlushHooks runs any hooks which are waiting out their debounce interval,
+// returning once they're done.  For use at the end of a one-shot run.
+func (r *Renewer) FlushHooks() {
+	r.hooks.fire()
+}
+
+func (h *hookRunner) runOne(command string, batch []hookEvent, extraEnv ...string) {
+	r := h.r
+	if !r.permitFileUpdate {
+		r.Logf("hook inhibited, not running %q for %d updates", command, len(batch))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+
+	// Output goes to a file rather than a pipe: with a pipe, a background
+	// process started by the hook holds it open and we'd wait on that too,
+	// even after the timeout kills the shell.
+	output, err := os.CreateTemp("", "ocsprenewer-hook")
+	if err != nil {
+		r.Errorf("hook %q: FAIL: %s", command, err)
+		return
+	}
+	defer func() {
+		_ = output.Close()
+		_ = os.Remove(output.Name())
+	}()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(append(os.Environ(), hookEnviron(batch)...), extraEnv...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err = cmd.Run()
+	took := time.Since(start)
+
+	if _, serr := output.Seek(0, io.SeekStart); serr == nil {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			r.Logf("hook %q: %s", command, scanner.Text())
+		}
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		r.Errorf("hook %q: FAIL timed out after %s", command, took.Round(time.Millisecond))
+	case err != nil:
+		r.Errorf("hook %q: FAIL after %s: %s", command, took.Round(time.Millisecond), err)
+	default:
+		r.LogAtf(1, "hook %q: ran for %d updates in %s", command, len(batch), took.Round(time.Millisecond))
+	}
+}
+
+// hookEnviron describes the batch to the hook.  The singular variables are
+// for the last update in the batch, which is all there is in the common
+// case; the plural ones are newline-separated and parallel to each other.
+func hookEnviron(batch []hookEvent) []string {
+	last := batch[len(batch)-1]
+	env := []string{
+		"OCSPRENEWER_CERT_PATH=" + last.certPath,
+		"OCSPRENEWER_STAPLE_PATH=" + last.staplePath,
+		"OCSPRENEWER_LABEL=" + last.label,
+		"OCSPRENEWER_OUTCOME=" + last.outcome,
+		"OCSPRENEWER_COUNT=" + strconv.Itoa(len(batch)),
+	}
+
+	var certPaths, staplePaths, labels, outcomes []string
+	for _, ev := range batch {
+		certPaths = append(certPaths, ev.certPath)
+		staplePaths = append(staplePaths, ev.staplePath)
+		labels = append(labels, ev.label)
+		outcomes = append(outcomes, ev.outcome)
+	}
+	return append(env,
+		"OCSPRENEWER_CERT_PATHS="+strings.Join(certPaths, "\n"),
+		"OCSPRENEWER_STAPLE_PATHS="+strings.Join(staplePaths, "\n"),
+		"OCSPRENEWER_LABELS="+strings.Join(labels, "\n"),
+		"OCSPRENEWER_OUTCOMES="+strings.Join(outcomes, "\n"),
+	)
+}
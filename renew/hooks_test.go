@@ -0,0 +1,198 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// hookLog has the hook record each run as a line in a file, with the cert
+// paths it was told about.
+func hookLog(t *testing.T) (command, logFile string) {
+	logFile = filepath.Join(t.TempDir(), "hook.log")
+	return `printf '%s\n' "$OCSPRENEWER_COUNT $(echo "$OCSPRENEWER_CERT_PATHS" | tr '\n' ' ')" >> ` + logFile, logFile
+}
+
+func hookRuns(t *testing.T, logFile string) []string {
+	t.Helper()
+	contents, err := os.ReadFile(logFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+func TestHooksDebounced(t *testing.T) {
+	const debounce = 300 * time.Millisecond
+	command, logFile := hookLog(t)
+	r := newTestRenewer(t, Config{Hooks: []string{command}, HookDebounce: debounce})
+	ca := newTestCA(t, "Test CA")
+
+	start := time.Now()
+	var certPaths []string
+	for _, name := range []string{"a.crt", "b.crt", "c.crt"} {
+		leaf, _ := ca.issue(t, &x509.Certificate{})
+		cr := &CertRenewal{Renewer: r, certPath: filepath.Join("/etc/ssl", name), policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+		if err := cr.findStaple(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cr.writeStaple(ca.staple(t, leaf)); err != nil {
+			t.Fatal(err)
+		}
+		certPaths = append(certPaths, cr.certPath)
+	}
+	if runs := hookRuns(t, logFile); runs != nil && time.Since(start) < debounce {
+		t.Fatalf("hook ran within the debounce interval: %q", runs)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hookRuns(t, logFile) == nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(2 * debounce)
+	want := []string{"3 " + strings.Join(certPaths, " ") + " "}
+	if runs := hookRuns(t, logFile); !reflect.DeepEqual(runs, want) {
+		t.Errorf("hook runs %q, want %q", runs, want)
+	}
+}
+
+func TestFlushHooks(t *testing.T) {
+	command, logFile := hookLog(t)
+	r := newTestRenewer(t, Config{Hooks: []string{command, "exit 1"}, HookDebounce: time.Hour})
+
+	r.FlushHooks()
+	if runs := hookRuns(t, logFile); runs != nil {
+		t.Errorf("hooks run with nothing pending: %q", runs)
+	}
+
+	r.hooks.queue(hookEvent{certPath: "/etc/ssl/a.crt", outcome: HookOutcomeRenewed, hooks: r.basePolicy.hooks})
+	r.FlushHooks()
+	if runs, want := hookRuns(t, logFile), []string{"1 /etc/ssl/a.crt "}; !reflect.DeepEqual(runs, want) {
+		t.Errorf("hook runs %q, want %q", runs, want)
+	}
+
+	// and nothing left to run later
+	r.FlushHooks()
+	if runs := hookRuns(t, logFile); len(runs) != 1 {
+		t.Errorf("hook runs %q after flushing again, want just the one", runs)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	r := newTestRenewer(t, Config{Hooks: []string{"sleep 30"}, HookTimeout: 100 * time.Millisecond})
+	r.hooks.queue(hookEvent{certPath: "/etc/ssl/a.crt", outcome: HookOutcomeRenewed, hooks: r.basePolicy.hooks})
+	start := time.Now()
+	r.FlushHooks()
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("hook timing out at 100ms took %s", took)
+	}
+}
+
+func TestHookEnviron(t *testing.T) {
+	got := hookEnviron([]hookEvent{
+		{certPath: "/etc/ssl/a.crt", staplePath: "/var/ocsp/a.ocsp", label: "a.example", outcome: HookOutcomeRenewed},
+		{certPath: "/etc/ssl/b.crt", staplePath: "/var/ocsp/b.ocsp", label: "b.example", outcome: HookOutcomeRenewed},
+	})
+	want := []string{
+		"OCSPRENEWER_CERT_PATH=/etc/ssl/b.crt",
+		"OCSPRENEWER_STAPLE_PATH=/var/ocsp/b.ocsp",
+		"OCSPRENEWER_LABEL=b.example",
+		"OCSPRENEWER_OUTCOME=renewed",
+		"OCSPRENEWER_COUNT=2",
+		"OCSPRENEWER_CERT_PATHS=/etc/ssl/a.crt\n/etc/ssl/b.crt",
+		"OCSPRENEWER_STAPLE_PATHS=/var/ocsp/a.ocsp\n/var/ocsp/b.ocsp",
+		"OCSPRENEWER_LABELS=a.example\nb.example",
+		"OCSPRENEWER_OUTCOMES=renewed\nrenewed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hookEnviron gave\n%q\nwant\n%q", got, want)
+	}
+}
+
+// Each hook hears about just the updates for certs whose policy wants it.
+func TestHooksPerPolicy(t *testing.T) {
+	allCommand, allLog := hookLog(t)
+	webCommand, webLog := hookLog(t)
+	r := newTestRenewer(t, Config{
+		Hooks:        []string{allCommand},
+		HookDebounce: time.Hour,
+		Policies:     []CertPolicy{{Match: "/etc/ssl/web", Hooks: []string{webCommand, allCommand}}},
+	})
+
+	for _, p := range []string{"/etc/ssl/mail/a.crt", "/etc/ssl/web/b.crt", "/etc/ssl/mail/c.crt"} {
+		r.hooks.queue(hookEvent{certPath: p, outcome: HookOutcomeRenewed, hooks: r.policyFor(p).hooks})
+	}
+	r.FlushHooks()
+
+	if runs, want := hookRuns(t, allLog), []string{"3 /etc/ssl/mail/a.crt /etc/ssl/web/b.crt /etc/ssl/mail/c.crt "}; !reflect.DeepEqual(runs, want) {
+		t.Errorf("global hook runs %q, want %q", runs, want)
+	}
+	if runs, want := hookRuns(t, webLog), []string{"1 /etc/ssl/web/b.crt "}; !reflect.DeepEqual(runs, want) {
+		t.Errorf("web hook runs %q, want %q", runs, want)
+	}
+}
+
+func TestHooksOnlyForWrittenStaples(t *testing.T) {
+	command, logFile := hookLog(t)
+	r := newTestRenewer(t, Config{Hooks: []string{command}, HookDebounce: time.Hour})
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	staple, raw := ca.staple(t, leaf)
+
+	newRenewal := func() *CertRenewal {
+		cr := &CertRenewal{Renewer: r, certPath: "/etc/ssl/site.crt", policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+		if err := cr.findStaple(); err != nil {
+			t.Fatal(err)
+		}
+		return cr
+	}
+	pending := func() int {
+		r.hooks.mu.Lock()
+		defer r.hooks.mu.Unlock()
+		return len(r.hooks.pending)
+	}
+
+	// With -not-really nothing is written, so there's nothing to reload.
+	r.SetNotReally(true)
+	if err := newRenewal().writeStaple(staple, raw); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 0 {
+		t.Errorf("%d hook events queued with file updates inhibited", n)
+	}
+
+	// An older response than what's on disk is rejected.
+	r.SetNotReally(false)
+	cr := newRenewal()
+	cr.oldStaple = &ocsp.Response{ThisUpdate: time.Now(), NextUpdate: time.Now().Add(2 * time.Hour)}
+	if err := cr.writeStaple(staple, raw); !errors.As(err, &RejectedStapleError{}) {
+		t.Fatalf("got %v, want the staple rejected", err)
+	}
+	if n := pending(); n != 0 {
+		t.Errorf("%d hook events queued for a rejected staple", n)
+	}
+
+	if err := newRenewal().writeStaple(staple, raw); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 1 {
+		t.Errorf("%d hook events queued for a written staple, want 1", n)
+	}
+	r.FlushHooks()
+	if runs := hookRuns(t, logFile); len(runs) != 1 {
+		t.Errorf("hook runs %q, want one", runs)
+	}
+}
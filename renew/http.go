@@ -0,0 +1,110 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StatusSummary is the top-level document served at /status
+type StatusSummary struct {
+	PID               string       `json:"pid"`
+	UserAgent         string       `json:"user_agent"`
+	Started           time.Time    `json:"started"`
+	Now               time.Time    `json:"now"`
+	EarliestNextRenew time.Time    `json:"earliest_next_renew"`
+	Certs             []CertStatus `json:"certs"`
+}
+
+// startHTTPStatus binds the listener synchronously, so that configuration
+// errors are reported at startup, then serves in the background.
+func (r *Renewer) startHTTPStatus() error {
+	if r.config.HTTPStatus == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", r.config.HTTPStatus)
+	if err != nil {
+		return err
+	}
+
+	r.Logf("HTTP status service listening on %s", listener.Addr())
+	server := &http.Server{
+		Handler:           r.HTTPHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	r.httpServer = server
+	go func() {
+		err := server.Serve(listener)
+		r.Logf("HTTP status service exited: %s", err)
+	}()
+	return nil
+}
+
+// HTTPHandler returns the handler for the status service, for callers who
+// want to mount it in their own server instead of setting Config.HTTPStatus.
+func (r *Renewer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", r.httpStatus)
+	mux.HandleFunc("/certs", r.httpCerts)
+	mux.HandleFunc("/cert", r.httpCert)
+	mux.HandleFunc("/metrics", r.httpMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.configMutex.RLock()
+		defer r.configMutex.RUnlock()
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func (r *Renewer) statusSummary() StatusSummary {
+	r.renewMutex.Lock()
+	earliest := r.earliestNextRenew
+	r.renewMutex.Unlock()
+
+	return StatusSummary{
+		PID:               thisPid,
+		UserAgent:         r.config.HTTPUserAgent,
+		Started:           r.started,
+		Now:               time.Now(),
+		EarliestNextRenew: earliest,
+		Certs:             r.CertStatuses(),
+	}
+}
+
+func (r *Renewer) httpStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.statusSummary())
+}
+
+func (r *Renewer) httpCerts(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.CertStatuses())
+}
+
+// httpCert takes a ?path= parameter, the path of the cert as tracked.
+func (r *Renewer) httpCert(w http.ResponseWriter, req *http.Request) {
+	p := req.URL.Query().Get("path")
+	if p == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing path parameter"})
+		return
+	}
+	if st, ok := r.certStatusOf(p); ok {
+		writeJSON(w, http.StatusOK, st)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "cert not tracked"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
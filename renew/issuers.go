@@ -0,0 +1,223 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// These are the usual places where an OS keeps a bundle of trust anchors.  We
+// can't get at the certificates inside x509.SystemCertPool() so we go read
+// the files ourselves.  The first one found wins, as they're normally all
+// the same data when several exist.
+var systemIssuerFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/usr/local/etc/ssl/cert.pem",                       // FreeBSD
+	"/etc/ssl/cert.pem",                                 // Alpine, OpenBSD
+	"/usr/local/share/certs/ca-root-nss.crt",            // DragonFly
+}
+
+// issuerStore holds candidate issuer certificates, indexed so that we can go
+// directly from an end-entity certificate to its issuer.
+//
+// There are two maps: one keyed by `X509v3 Subject Key Identifier`, for which
+// the entity cert's `X509v3 Authority Key Identifier` is used as the lookup
+// key, and a backup map of Subject DN, with the entity cert's Issuer DN used
+// as the lookup key.  Both hold slices, since cross-signing and re-issuance
+// mean several certs can share a key or a name; we check signatures to pick.
+type issuerStore struct {
+	mu        sync.RWMutex
+	bySKI     map[string][]*x509.Certificate
+	bySubject map[string][]*x509.Certificate
+	count     int
+}
+
+func newIssuerStore() *issuerStore {
+	return &issuerStore{
+		bySKI:     make(map[string][]*x509.Certificate),
+		bySubject: make(map[string][]*x509.Certificate),
+	}
+}
+
+// add returns false if the cert was already known.
+func (is *issuerStore) add(cert *x509.Certificate) bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	subject := string(cert.RawSubject)
+	for _, have := range is.bySubject[subject] {
+		if bytes.Equal(have.Raw, cert.Raw) {
+			return false
+		}
+	}
+	is.bySubject[subject] = append(is.bySubject[subject], cert)
+	if len(cert.SubjectKeyId) > 0 {
+		ski := string(cert.SubjectKeyId)
+		is.bySKI[ski] = append(is.bySKI[ski], cert)
+	}
+	is.count++
+	return true
+}
+
+func (is *issuerStore) size() int {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return is.count
+}
+
+// lookup finds an issuer for the given certificate, preferring a match by key
+// identifier and only falling back to the name if that fails.  We require that
+// the candidate actually signed the cert.
+func (is *issuerStore) lookup(cert *x509.Certificate) *x509.Certificate {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	if len(cert.AuthorityKeyId) > 0 {
+		for _, candidate := range is.bySKI[string(cert.AuthorityKeyId)] {
+			if cert.CheckSignatureFrom(candidate) == nil {
+				return candidate
+			}
+		}
+	}
+	for _, candidate := range is.bySubject[string(cert.RawIssuer)] {
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// loadPath loads either one file or all the files directly within a directory.
+// For directories, we don't recurse and we skip anything which doesn't parse,
+// since CA directories often have hash symlinks, CRLs and READMEs mixed in.
+func (is *issuerStore) loadPath(p string) (int, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return is.loadFile(p)
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, e := range entries {
+		fn := filepath.Join(p, e.Name())
+		fi, err := os.Stat(fn) // follow symlinks
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() > MaxCertFileSize {
+			continue
+		}
+		n, _ := is.loadFile(fn)
+		total += n
+	}
+	return total, nil
+}
+
+// loadFile takes a file with zero or more PEM certificates, or one DER
+// certificate.
+func (is *issuerStore) loadFile(fn string) (int, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", fn, err)
+	}
+	added := 0
+	for _, c := range certs {
+		if !c.IsCA {
+			continue
+		}
+		if is.add(c) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// parseCertificates handles a sequence of PEM-encoded certificates (ignoring
+// any other PEM blocks) or, failing that, a single DER-encoded certificate.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	sawPEM := false
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		sawPEM = true
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if sawPEM {
+		return certs, nil
+	}
+
+	c, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{c}, nil
+}
+
+// loadIssuers builds the issuer store per c.
+func (r *Renewer) loadIssuers(c Config) (*issuerStore, error) {
+	issuers := newIssuerStore()
+
+	for _, p := range c.IssuerPaths {
+		n, err := issuers.loadPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("loading issuers: %w", err)
+		}
+		r.Logf("loaded %d issuer certificates from %q", n, p)
+	}
+
+	if c.IssuerCacheDir != "" {
+		if err := os.MkdirAll(c.IssuerCacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("issuer cache: %w", err)
+		}
+		n, err := issuers.loadPath(c.IssuerCacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("issuer cache: %w", err)
+		}
+		r.Logf("loaded %d cached issuer certificates from %q", n, c.IssuerCacheDir)
+	}
+
+	if c.SystemIssuers {
+		for _, fn := range systemIssuerFiles {
+			n, err := issuers.loadFile(fn)
+			if err != nil {
+				continue
+			}
+			r.Logf("loaded %d system issuer certificates from %q", n, fn)
+			break
+		}
+	}
+
+	return issuers, nil
+}
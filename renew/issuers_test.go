@@ -0,0 +1,127 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIssuerStoreLookup(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	rekeyed := newTestCA(t, "Test CA") // same name, new key
+	other := newTestCA(t, "Other CA")
+	impostor := newTestCA(t, "Test CA") // never added to the store
+
+	store := newIssuerStore()
+	for _, c := range []*x509.Certificate{ca.cert, rekeyed.cert, other.cert} {
+		if !store.add(c) {
+			t.Fatalf("add(%q) said already known", c.Subject.CommonName)
+		}
+	}
+	if store.add(ca.cert) {
+		t.Error("adding the same cert twice should say it was already known")
+	}
+	if n := store.size(); n != 3 {
+		t.Errorf("store size %d, want 3", n)
+	}
+
+	// signedWithKeyID has ca sign a leaf, claiming the given Authority Key
+	// Identifier; nil means none at all, so only the name can find it.
+	signedWithKeyID := func(ca *testCA, aki []byte) *x509.Certificate {
+		parent := *ca.cert
+		parent.SubjectKeyId = aki
+		key := newTestKey(t)
+		return signTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf.example"}}, &parent, key.Public(), ca.key)
+	}
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	rekeyedLeaf, _ := rekeyed.issue(t, &x509.Certificate{})
+	otherLeaf, _ := other.issue(t, &x509.Certificate{})
+	impostorLeaf, _ := impostor.issue(t, &x509.Certificate{})
+
+	for _, tc := range []struct {
+		name string
+		cert *x509.Certificate
+		want *x509.Certificate
+	}{
+		{"by key identifier", leaf, ca.cert},
+		{"by key identifier, after re-keying", rekeyedLeaf, rekeyed.cert},
+		{"other CA", otherLeaf, other.cert},
+		{"by name, checking signatures", signedWithKeyID(rekeyed, nil), rekeyed.cert},
+		{"by name, key identifier unknown", signedWithKeyID(ca, []byte("not a key id")), ca.cert},
+		{"name matches but no signature does", impostorLeaf, nil},
+		{"name matches, no key identifier, no signature", signedWithKeyID(impostor, nil), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := store.lookup(tc.cert)
+			switch {
+			case got == nil && tc.want == nil:
+			case got == nil:
+				t.Errorf("found no issuer, want %q", tc.want.Subject)
+			case tc.want == nil:
+				t.Errorf("found issuer %q, want none", got.Subject)
+			case !got.Equal(tc.want):
+				t.Errorf("found issuer with key id %x, want %x", got.SubjectKeyId, tc.want.SubjectKeyId)
+			}
+		})
+	}
+}
+
+func TestIssuerStoreLoadPath(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	pemOf := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+
+	// A bundle with a leaf and some other PEM block mixed in: only the CA is
+	// an issuer.
+	var bundle []byte
+	bundle = append(bundle, pemOf("CERTIFICATE", leaf.Raw)...)
+	bundle = append(bundle, pemOf("X509 CRL", []byte("not really a CRL"))...)
+	bundle = append(bundle, pemOf("CERTIFICATE", ca.cert.Raw)...)
+	bundleFile := write("bundle.pem", bundle)
+	write("other.der", other.cert.Raw)
+	write("leaf.der", leaf.Raw)
+	write("README", []byte("These are our CA certs.\n"))
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newIssuerStore()
+	if n, err := store.loadPath(bundleFile); err != nil || n != 1 {
+		t.Errorf("loading bundle: got %d, %v; want 1 CA cert", n, err)
+	}
+	if n, err := store.loadPath(dir); err != nil || n != 1 {
+		t.Errorf("loading directory: got %d, %v; want just the 1 new CA cert", n, err)
+	}
+	if n := store.size(); n != 2 {
+		t.Errorf("store size %d, want 2", n)
+	}
+	if got := store.lookup(leaf); got == nil || !got.Equal(ca.cert) {
+		t.Errorf("leaf's issuer not found after loading")
+	}
+
+	if _, err := store.loadPath(filepath.Join(dir, "README")); err == nil {
+		t.Error("loading a file which isn't certs should fail")
+	}
+	if _, err := store.loadPath(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loading a missing file should fail")
+	}
+}
@@ -5,14 +5,31 @@
 package renew // import "go.pennock.tech/ocsprenewer/renew"
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
 )
 
-func (r *Renewer) rawLogf(spec string, args ...interface{}) {
-	log.Printf(spec, args...)
-}
+// Values for Config.LogFormat
+const (
+	LogFormatLogfmt = "logfmt" // key=value pairs, one record per line; the default
+	LogFormatJSON   = "json"   // one JSON object per line
+)
+
+// Field names used in log records, beyond slog's own time, level and msg.
+const (
+	LogKeyPID       = "pid"
+	LogKeyActionID  = "action_id"
+	LogKeyCert      = "cert"
+	LogKeyPath      = "path"
+	LogKeyResponder = "responder"
+	LogKeyOutcome   = "outcome"
+	LogKeyError     = "error"
+)
 
 var thisPid string
 
@@ -20,33 +37,131 @@ func init() {
 	thisPid = strconv.Itoa(os.Getpid())
 }
 
+// NewLogHandler returns a handler writing records to w in the given format,
+// one of the LogFormat* constants.
+func NewLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "", LogFormatLogfmt:
+		return slog.NewTextHandler(w, opts), nil
+	case LogFormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// VerbosityLevel is the slog level used by LogAtf for a given verbosity:
+// level 1 is slog.LevelDebug, and each level after that is four lower.
+func VerbosityLevel(lvl uint) slog.Level {
+	return slog.LevelInfo - slog.Level(4*lvl)
+}
+
+// SetLogHandler sends our logging to h, in place of Config.LogHandler or the
+// handler made from Config.LogFormat.  Call it before Start or OneShot.
+// Records at LogAtf's verbosity levels are only passed on once SetLogLevel
+// has enabled them, but h must also let them through if they're wanted; see
+// VerbosityLevel.
+func (r *Renewer) SetLogHandler(h slog.Handler) {
+	r.logHandler = h
+	r.logger = slog.New(h).With(LogKeyPID, thisPid)
+}
+
+// Logger returns the logger we use, for callers who want their own records
+// to go to the same place.
+func (r *Renewer) Logger() *slog.Logger {
+	return r.logger
+}
+
+func (r *Renewer) logAt(level slog.Level, attrs []slog.Attr, spec string, args ...interface{}) {
+	if !r.logger.Enabled(context.Background(), level) {
+		return
+	}
+	r.logger.LogAttrs(context.Background(), level, fmt.Sprintf(spec, args...), attrs...)
+}
+
 func (r *Renewer) Logf(spec string, args ...interface{}) {
-	t := make([]interface{}, 1, len(args)+1)
-	t[0] = thisPid
-	t = append(t, args...)
-	r.rawLogf("[pid=%s] "+spec, t...)
+	r.logAt(slog.LevelInfo, nil, spec, args...)
 }
 
 func (r *Renewer) LogAtf(level uint, spec string, args ...interface{}) {
 	if r.logLevel >= level {
-		r.Logf(spec, args...)
+		r.logAt(VerbosityLevel(level), nil, spec, args...)
 	}
 }
 
-func (cr *CertRenewal) CertLogf(spec string, args ...interface{}) {
-	t := make([]interface{}, 3, len(args)+3)
-	if cr.actionIDStr == "" {
-		cr.actionIDStr = strconv.FormatUint(uint64(cr.ActionID), 10)
+// Warnf is for trouble which we expect to recover from, eg by retrying.
+func (r *Renewer) Warnf(spec string, args ...interface{}) {
+	r.logAt(slog.LevelWarn, nil, spec, args...)
+}
+
+// Errorf is for trouble which needs someone to look at it.
+func (r *Renewer) Errorf(spec string, args ...interface{}) {
+	r.logAt(slog.LevelError, nil, spec, args...)
+}
+
+// certAttrs are the fields identifying what a CertRenewal is working on.
+func (cr *CertRenewal) certAttrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, 4)
+	attrs = append(attrs, slog.Any(LogKeyActionID, cr.ActionID))
+	if cr.cert != nil {
+		attrs = append(attrs, slog.String(LogKeyCert, cr.certLabel()))
 	}
-	t[0] = thisPid
-	t[1] = cr.actionIDStr
-	t[2] = cr.certLabel()
-	t = append(t, args...)
-	cr.rawLogf("[pid=%s] [actId=%s] [cert=%q] "+spec, t...)
+	attrs = append(attrs, slog.String(LogKeyPath, cr.certPath))
+	if cr.responderURL != "" {
+		attrs = append(attrs, slog.String(LogKeyResponder, cr.responderURL))
+	}
+	return attrs
+}
+
+func (cr *CertRenewal) CertLogf(spec string, args ...interface{}) {
+	cr.logAt(slog.LevelInfo, cr.certAttrs(), spec, args...)
 }
 
 func (cr *CertRenewal) CertLogAtf(level uint, spec string, args ...interface{}) {
 	if cr.Renewer.logLevel >= level {
-		cr.CertLogf(spec, args...)
+		cr.logAt(VerbosityLevel(level), cr.certAttrs(), spec, args...)
+	}
+}
+
+func (cr *CertRenewal) CertWarnf(spec string, args ...interface{}) {
+	cr.logAt(slog.LevelWarn, cr.certAttrs(), spec, args...)
+}
+
+func (cr *CertRenewal) CertErrorf(spec string, args ...interface{}) {
+	cr.logAt(slog.LevelError, cr.certAttrs(), spec, args...)
+}
+
+// outcome classifies the end result of handling the cert, given the error
+// from that handling, as one of the Result* values.
+func (cr *CertRenewal) outcome(err error) string {
+	var revoked RevokedError
+	switch {
+	case errors.As(err, &revoked):
+		return ResultRevoked
+	case err != nil:
+		return ResultFailed
+	case cr.attempted:
+		return ResultRenewed
+	}
+	return ResultSkipped
+}
+
+// logOutcome gives one record per cert handled, with the outcome as a field,
+// so that log pipelines needn't pick apart the messages.
+func (cr *CertRenewal) logOutcome(err error) {
+	if err == ErrNoOCSPFlagfile {
+		return
+	}
+	outcome := cr.outcome(err)
+	attrs := append(cr.certAttrs(), slog.String(LogKeyOutcome, outcome))
+	switch outcome {
+	case ResultFailed, ResultRevoked:
+		attrs = append(attrs, slog.String(LogKeyError, err.Error()))
+		cr.logAt(slog.LevelWarn, attrs, "cert handled")
+	case ResultSkipped:
+		if cr.Renewer.logLevel >= 1 {
+			cr.logAt(VerbosityLevel(1), attrs, "cert handled")
+		}
+	default:
+		cr.logAt(slog.LevelInfo, attrs, "cert handled")
 	}
 }
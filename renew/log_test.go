@@ -0,0 +1,138 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends r's logging to a buffer, as JSON records, at r's level.
+func captureLogs(t *testing.T, r *Renewer) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	h, err := NewLogHandler(&buf, LogFormatJSON, &slog.HandlerOptions{Level: &r.logVar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetLogHandler(h)
+	return &buf
+}
+
+// logRecords decodes and empties what captureLogs has collected.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		rec := make(map[string]interface{})
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestNewLogHandler(t *testing.T) {
+	for _, format := range []string{"", LogFormatLogfmt, LogFormatJSON} {
+		var buf bytes.Buffer
+		h, err := NewLogHandler(&buf, format, nil)
+		if err != nil {
+			t.Fatalf("format %q: %s", format, err)
+		}
+		logger := slog.New(h)
+		logger.Debug("hidden")
+		logger.Info("hello", LogKeyPath, "/etc/ssl/site.crt")
+
+		got := buf.String()
+		if format == LogFormatJSON {
+			var rec map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &rec); err != nil || rec["msg"] != "hello" || rec[LogKeyPath] != "/etc/ssl/site.crt" {
+				t.Errorf("format %q wrote %q (%v)", format, got, err)
+			}
+		} else if !strings.HasSuffix(got, "level=INFO msg=hello path=/etc/ssl/site.crt\n") || strings.Count(got, "\n") != 1 {
+			t.Errorf("format %q wrote %q", format, got)
+		}
+	}
+
+	if _, err := NewLogHandler(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Error("no error for an unknown log format")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	r := newTestRenewer(t, Config{})
+	buf := captureLogs(t, r)
+
+	r.LogAtf(1, "verbose")
+	r.Logf("info")
+	r.Warnf("warning")
+	r.Errorf("error")
+	r.SetLogLevel(2)
+	r.LogAtf(1, "verbose now")
+	r.LogAtf(2, "more verbose")
+	r.LogAtf(3, "too verbose")
+
+	var got []string
+	for _, rec := range logRecords(t, buf) {
+		if rec[LogKeyPID] != thisPid {
+			t.Errorf("record %v has no pid", rec)
+		}
+		got = append(got, rec["level"].(string)+" "+rec["msg"].(string))
+	}
+	want := "INFO info,WARN warning,ERROR error,DEBUG verbose now,DEBUG-4 more verbose"
+	if strings.Join(got, ",") != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestLogOutcome(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	r := newTestRenewer(t, Config{})
+	buf := captureLogs(t, r)
+
+	for _, tc := range []struct {
+		name      string
+		attempted bool
+		err       error
+		level     string // "" for no record
+		outcome   string
+	}{
+		{"renewed", true, nil, "INFO", ResultRenewed},
+		{"skipped", false, nil, "", ""},
+		{"failed", true, ErrHTTPFailure, "WARN", ResultFailed},
+		{"revoked", true, RevokedError{Cert: leaf}, "WARN", ResultRevoked},
+		{"flagged", false, ErrNoOCSPFlagfile, "", ""},
+	} {
+		cr := &CertRenewal{Renewer: r, ActionID: 42, certPath: "/etc/ssl/site.crt", cert: leaf, attempted: tc.attempted, responderURL: "http://ocsp.example/"}
+		cr.logOutcome(tc.err)
+		records := logRecords(t, buf)
+		if tc.level == "" {
+			if len(records) != 0 {
+				t.Errorf("%s: logged %v", tc.name, records)
+			}
+			continue
+		}
+		if len(records) != 1 {
+			t.Fatalf("%s: logged %d records, want 1", tc.name, len(records))
+		}
+		rec := records[0]
+		if rec["level"] != tc.level || rec[LogKeyOutcome] != tc.outcome {
+			t.Errorf("%s: level %v outcome %v, want %s %s", tc.name, rec["level"], rec[LogKeyOutcome], tc.level, tc.outcome)
+		}
+		if rec[LogKeyActionID] != float64(42) || rec[LogKeyCert] != "leaf.example" || rec[LogKeyPath] != cr.certPath || rec[LogKeyResponder] != cr.responderURL {
+			t.Errorf("%s: record %v doesn't identify the cert", tc.name, rec)
+		}
+		if (tc.err != nil) != (rec[LogKeyError] != nil) {
+			t.Errorf("%s: error field %v, want one if and only if it failed", tc.name, rec[LogKeyError])
+		}
+	}
+}
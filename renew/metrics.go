@@ -0,0 +1,224 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We emit the Prometheus text exposition format directly; the handful of
+// metrics we have don't justify pulling in the client library and its
+// dependency tree.
+
+// Outcomes of a single fetch from an OCSP responder, used as metric labels.
+const (
+	FetchGood         = "good"
+	FetchRevoked      = "revoked"
+	FetchUnknown      = "unknown"
+	FetchTryLater     = "try_later"
+	FetchOCSPError    = "ocsp_error" // any other OCSP error status
+	FetchHTTPFailure  = "http_failure"
+	FetchParseFailure = "parse_failure"
+)
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; len(latencyBuckets)+1 for +Inf
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// fetchMethods are the HTTP methods we label fetch metrics with.
+var fetchMethods = []string{http.MethodGet, http.MethodPost}
+
+// fetchKey labels one fetch from an OCSP responder: by outcome for the
+// attempts counter, by responder host for the latency histogram.
+type fetchKey struct {
+	label  string
+	method string
+}
+
+type metrics struct {
+	mu           sync.Mutex
+	fetches      map[fetchKey]uint64     // labelled by outcome
+	rejections   map[string]uint64       // keyed by rejectionLabels
+	latency      map[fetchKey]*histogram // labelled by responder host
+	sweeps       uint64
+	failedSweeps uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		fetches:    make(map[fetchKey]uint64),
+		rejections: make(map[string]uint64),
+		latency:    make(map[fetchKey]*histogram),
+	}
+}
+
+func (m *metrics) fetchOutcome(outcome, method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches[fetchKey{outcome, method}]++
+}
+
+// rejectionLabels gives the metric label for each reason a response might
+// fail validation.
+var rejectionLabels = map[error]string{
+	ErrThisUpdateInFuture:   "this_update_in_future",
+	ErrMissingNextUpdate:    "missing_next_update",
+	ErrNextUpdateBeforeThis: "next_update_before_this_update",
+	ErrValidityTooShort:     "validity_too_short",
+	ErrUnauthorizedSigner:   "unauthorized_signer",
+	ErrStapleRegression:     "older_than_existing",
+}
+
+func (m *metrics) stapleRejected(reason error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejections[rejectionLabels[reason]]++
+}
+
+func (m *metrics) responderLatency(responderURL, method string, d time.Duration) {
+	key := fetchKey{responderHost(responderURL), method}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latency[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) sweepDone(failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweeps++
+	if failed {
+		m.failedSweeps++
+	}
+}
+
+// WriteMetrics writes all metrics in the Prometheus text exposition format.
+func (r *Renewer) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := r.metrics
+
+	m.mu.Lock()
+	fmt.Fprintf(bw, "# HELP ocsprenewer_fetch_attempts_total OCSP fetch attempts, by outcome and the HTTP method of the final request.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_fetch_attempts_total counter\n")
+	for _, outcome := range []string{FetchGood, FetchRevoked, FetchUnknown, FetchTryLater, FetchOCSPError, FetchHTTPFailure, FetchParseFailure} {
+		for _, method := range fetchMethods {
+			fmt.Fprintf(bw, "ocsprenewer_fetch_attempts_total{outcome=%s,method=%s} %d\n",
+				promQuote(outcome), promQuote(method), m.fetches[fetchKey{outcome, method}])
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP ocsprenewer_staples_rejected_total Fetched OCSP responses refused by validation, by reason.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_staples_rejected_total counter\n")
+	reasons := make([]string, 0, len(rejectionLabels))
+	for _, reason := range rejectionLabels {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(bw, "ocsprenewer_staples_rejected_total{reason=%s} %d\n", promQuote(reason), m.rejections[reason])
+	}
+
+	fmt.Fprintf(bw, "# HELP ocsprenewer_responder_latency_seconds Time taken for OCSP responders to answer.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_responder_latency_seconds histogram\n")
+	keys := make([]fetchKey, 0, len(m.latency))
+	for key := range m.latency {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].label != keys[j].label {
+			return keys[i].label < keys[j].label
+		}
+		return keys[i].method < keys[j].method
+	})
+	for _, key := range keys {
+		h := m.latency[key]
+		label := promQuote(key.label) + ",method=" + promQuote(key.method)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "ocsprenewer_responder_latency_seconds_bucket{responder=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "ocsprenewer_responder_latency_seconds_bucket{responder=%s,le=\"+Inf\"} %d\n", label, h.total)
+		fmt.Fprintf(bw, "ocsprenewer_responder_latency_seconds_sum{responder=%s} %g\n", label, h.sum)
+		fmt.Fprintf(bw, "ocsprenewer_responder_latency_seconds_count{responder=%s} %d\n", label, h.total)
+	}
+
+	fmt.Fprintf(bw, "# HELP ocsprenewer_sweeps_total Sweeps over certs, timer-based or full.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_sweeps_total counter\n")
+	fmt.Fprintf(bw, "ocsprenewer_sweeps_total %d\n", m.sweeps)
+	fmt.Fprintf(bw, "# HELP ocsprenewer_sweeps_failed_total Sweeps which encountered at least one failure.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_sweeps_failed_total counter\n")
+	fmt.Fprintf(bw, "ocsprenewer_sweeps_failed_total %d\n", m.failedSweeps)
+	m.mu.Unlock()
+
+	now := time.Now()
+	statuses := r.CertStatuses()
+	fmt.Fprintf(bw, "# HELP ocsprenewer_staple_expiry_timestamp_seconds When the current staple's nextUpdate falls, as a Unix timestamp.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_staple_expiry_timestamp_seconds gauge\n")
+	for _, st := range statuses {
+		if st.NextUpdate.IsZero() {
+			continue
+		}
+		fmt.Fprintf(bw, "ocsprenewer_staple_expiry_timestamp_seconds{%s} %d\n", certLabels(st), st.NextUpdate.Unix())
+	}
+	fmt.Fprintf(bw, "# HELP ocsprenewer_cert_in_danger Whether the cert's staple is past T2, or failing with none usable.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_cert_in_danger gauge\n")
+	for _, st := range statuses {
+		danger := 0
+		if st.InDanger {
+			danger = 1
+		}
+		fmt.Fprintf(bw, "ocsprenewer_cert_in_danger{%s} %d\n", certLabels(st), danger)
+	}
+	fmt.Fprintf(bw, "# HELP ocsprenewer_next_check_seconds Seconds until the next scheduled check of the cert.\n")
+	fmt.Fprintf(bw, "# TYPE ocsprenewer_next_check_seconds gauge\n")
+	for _, st := range statuses {
+		if st.NextCheck.IsZero() {
+			continue
+		}
+		fmt.Fprintf(bw, "ocsprenewer_next_check_seconds{%s} %g\n", certLabels(st), st.NextCheck.Sub(now).Seconds())
+	}
+
+	return bw.Flush()
+}
+
+func certLabels(st CertStatus) string {
+	return "path=" + promQuote(st.Path) + ",cert=" + promQuote(st.Label)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promQuote(s string) string {
+	return `"` + promEscaper.Replace(s) + `"`
+}
+
+func (r *Renewer) httpMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteMetrics(w)
+}
@@ -0,0 +1,335 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Webhook notifier defaults, used when the Config fields are zero.
+const (
+	DefaultExpiryWarning = 24 * time.Hour
+	DefaultNotifyRepeat  = 6 * time.Hour
+
+	// Each webhook delivery is tried this many times, with doubling delays
+	// from webhookRetryDelay between.
+	WebhookAttempts   = 4
+	webhookRetryDelay = 2 * time.Second
+	webhookTimeout    = 10 * time.Second
+)
+
+// Values for NotifyEvent.Event
+const (
+	EventFailed    = "renewal_failed"
+	EventExpiring  = "staple_expiring"
+	EventRevoked   = "revoked"
+	EventUnknown   = "unknown_at_ca"
+	EventRecovered = "recovered"
+)
+
+// Webhook request headers.  The signature is "sha256=" and the hex HMAC-SHA256
+// of the body, keyed with Config.WebhookSecret.
+const (
+	HeaderWebhookEvent     = "X-Ocsprenewer-Event"
+	HeaderWebhookDelivery  = "X-Ocsprenewer-Delivery"
+	HeaderWebhookSignature = "X-Ocsprenewer-Signature"
+)
+
+// NotifyEvent is the JSON body POSTed to webhooks.
+type NotifyEvent struct {
+	ID                  string    `json:"id"` // the same across retries of one delivery
+	Event               string    `json:"event"`
+	Time                time.Time `json:"time"`
+	Host                string    `json:"host"`
+	Path                string    `json:"path"`
+	Label               string    `json:"label"`
+	Serial              string    `json:"serial"`
+	StaplePath          string    `json:"staple_path"`
+	NextUpdate          time.Time `json:"next_update"` // of the staple we have, if any
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+var thisHost string
+
+func init() {
+	thisHost, _ = os.Hostname()
+}
+
+// notifier de-duplicates events and delivers them to the webhooks.  The same
+// problem event for a cert is not repeated within NotifyRepeat while we've
+// not told anyone it recovered, so a cert failing every retry doesn't page
+// every retry; recovered is only sent after a problem was.
+type notifier struct {
+	r *Renewer
+
+	mu    sync.Mutex
+	certs map[string]*notifyState // by cert path
+
+	inflight sync.WaitGroup
+}
+
+type notifyState struct {
+	problem  bool                 // we've notified a problem, not yet recovery
+	lastSent map[string]time.Time // by event
+	onceSent map[string]bool      // by event, for those only ever sent once
+}
+
+func newNotifier(r *Renewer) *notifier {
+	return &notifier{r: r, certs: make(map[string]*notifyState)}
+}
+
+func (n *notifier) expiryWarning() time.Duration {
+	if n.r.config.ExpiryWarning > 0 {
+		return n.r.config.ExpiryWarning
+	}
+	return DefaultExpiryWarning
+}
+
+func (n *notifier) repeat() time.Duration {
+	if n.r.config.NotifyRepeat > 0 {
+		return n.r.config.NotifyRepeat
+	}
+	return DefaultNotifyRepeat
+}
+
+// notifyOutcome is called with the outcome of handling the cert, as for
+// recordStatus, and works out which events that means.
+func (cr *CertRenewal) notifyOutcome(err error) {
+	n := cr.Renewer.notifier
+	if len(cr.Renewer.config.WebhookURLs) == 0 || cr.cert == nil {
+		return
+	}
+	if err == ErrNoOCSPFlagfile || err == ErrNoOCSPInCert {
+		return
+	}
+
+	var (
+		revoked RevokedError
+		unknown UnknownAtCAError
+	)
+	switch {
+	case errors.As(err, &revoked):
+		n.emit(cr, EventRevoked, err)
+		return // expiry doesn't matter any more
+	case errors.As(err, &unknown):
+		n.emit(cr, EventUnknown, err)
+	case err != nil:
+		n.emit(cr, EventFailed, err)
+	}
+
+	staple := cr.newStaple
+	if staple == nil {
+		staple = cr.oldStaple
+	}
+	warning := n.expiryWarning()
+	expiring := staple != nil && !staple.NextUpdate.IsZero() && time.Until(staple.NextUpdate) < warning
+	if expiring && cr.newStaple != nil {
+		// We've just renewed, and can't do better than what the CA gives
+		// us.  If that's always going to be within the warning, because
+		// its validity window is shorter, that's worth saying once, not on
+		// every renewal; otherwise the CA gave us an old response and the
+		// timers will deal with it.
+		expiring = false
+		if staple.NextUpdate.Sub(staple.ThisUpdate) < warning {
+			n.emitOnce(cr, EventExpiring, nil)
+		}
+	}
+
+	switch {
+	case expiring:
+		n.emit(cr, EventExpiring, err)
+	case err == nil && cr.attempted:
+		n.emit(cr, EventRecovered, nil)
+	}
+}
+
+// state returns the notification state for the cert; the caller must hold
+// n.mu.
+func (n *notifier) state(certPath string) *notifyState {
+	st, ok := n.certs[certPath]
+	if !ok {
+		st = &notifyState{lastSent: make(map[string]time.Time), onceSent: make(map[string]bool)}
+		n.certs[certPath] = st
+	}
+	return st
+}
+
+// forget drops what we've sent for the cert, once it's no longer tracked; a
+// cert found again later starts afresh.
+func (n *notifier) forget(certPath string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.certs, certPath)
+}
+
+// emitOnce sends event for the cert only if it never has been before.  It
+// is not a problem which recovered would clear.
+func (n *notifier) emitOnce(cr *CertRenewal, event string, err error) {
+	n.mu.Lock()
+	st := n.state(cr.certPath)
+	sent := st.onceSent[event]
+	st.onceSent[event] = true
+	n.mu.Unlock()
+	if sent {
+		return
+	}
+	n.send(cr, event, err, time.Now())
+}
+
+func (n *notifier) emit(cr *CertRenewal, event string, err error) {
+	now := time.Now()
+
+	n.mu.Lock()
+	st := n.state(cr.certPath)
+	if event == EventRecovered {
+		if !st.problem {
+			n.mu.Unlock()
+			return
+		}
+		st.problem = false
+		st.lastSent = make(map[string]time.Time)
+	} else {
+		if last, ok := st.lastSent[event]; ok && st.problem && now.Sub(last) < n.repeat() {
+			n.mu.Unlock()
+			cr.CertLogAtf(1, "not repeating %s notification, last sent %s", event, last)
+			return
+		}
+		st.problem = true
+		st.lastSent[event] = now
+	}
+	n.mu.Unlock()
+
+	n.send(cr, event, err, now)
+}
+
+// send builds the notification and starts its deliveries.
+func (n *notifier) send(cr *CertRenewal, event string, err error, now time.Time) {
+	ev := NotifyEvent{
+		ID:                  newDeliveryID(),
+		Event:               event,
+		Time:                now,
+		Host:                thisHost,
+		Path:                cr.certPath,
+		Label:               cr.certLabel(),
+		Serial:              cr.cert.SerialNumber.Text(16),
+		StaplePath:          cr.staplePath,
+		ConsecutiveFailures: cr.Renewer.consecutiveFailures(cr.certPath),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if cr.newStaple != nil {
+		ev.NextUpdate = cr.newStaple.NextUpdate
+	} else if cr.oldStaple != nil {
+		ev.NextUpdate = cr.oldStaple.NextUpdate
+	}
+
+	body, jerr := json.Marshal(ev)
+	if jerr != nil {
+		cr.CertErrorf("FAIL encoding %s notification: %s", event, jerr)
+		return
+	}
+	if !cr.Renewer.permitRemoteComms {
+		cr.CertLogf("remote comms inhibited, not sending %s notification", event)
+		return
+	}
+	// Deliveries run on after this sweep, maybe past a reload, so take what
+	// they need from the configuration now.
+	header := n.headers(ev, body)
+	for _, u := range cr.Renewer.config.WebhookURLs {
+		n.inflight.Add(1)
+		go n.deliver(u, ev, body, header)
+	}
+}
+
+// headers gives the HTTP headers for delivering ev, with body signed if we
+// have a secret.
+func (n *notifier) headers(ev NotifyEvent, body []byte) http.Header {
+	h := make(http.Header)
+	h.Set("User-Agent", n.r.config.HTTPUserAgent)
+	h.Set("Content-Type", "application/json")
+	h.Set(HeaderWebhookEvent, ev.Event)
+	h.Set(HeaderWebhookDelivery, ev.ID)
+	if secret := n.r.config.WebhookSecret; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		h.Set(HeaderWebhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return h
+}
+
+func (n *notifier) deliver(webhookURL string, ev NotifyEvent, body []byte, header http.Header) {
+	defer n.inflight.Done()
+	r := n.r
+	delay := webhookRetryDelay
+	var err error
+	for attempt := 1; attempt <= WebhookAttempts; attempt++ {
+		if err = n.post(webhookURL, body, header); err == nil {
+			r.LogAtf(1, "sent %s notification for %q to %q", ev.Event, ev.Path, webhookURL)
+			return
+		}
+		if attempt < WebhookAttempts {
+			r.Logf("webhook %q: attempt %d of %s notification for %q failed, retrying in %s: %s",
+				webhookURL, attempt, ev.Event, ev.Path, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-r.abandonCtx.Done():
+				r.Errorf("FAIL webhook %q: shutting down, giving up on %s notification for %q: %s", webhookURL, ev.Event, ev.Path, err)
+				return
+			}
+			delay *= 2
+		}
+	}
+	r.Errorf("FAIL webhook %q: giving up on %s notification for %q: %s", webhookURL, ev.Event, ev.Path, err)
+}
+
+func (n *notifier) post(webhookURL string, body []byte, header http.Header) error {
+	ctx, cancel := context.WithTimeout(n.r.abandonCtx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+
+	resp, err := n.r.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// FlushNotifications waits for webhook deliveries in progress, including
+// their retries.  For use at the end of a one-shot run.
+func (r *Renewer) FlushNotifications() {
+	r.notifier.inflight.Wait()
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
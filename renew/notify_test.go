@@ -0,0 +1,161 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// webhookReceiver records what's POSTed to it, checking the signature if it
+// has a secret.
+type webhookReceiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	mu     sync.Mutex
+	events []NotifyEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	wr := &webhookReceiver{t: t, secret: secret}
+	wr.Server = httptest.NewServer(http.HandlerFunc(wr.serveHTTP))
+	t.Cleanup(wr.Close)
+	return wr
+}
+
+func (wr *webhookReceiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		wr.t.Errorf("reading webhook body: %s", err)
+		return
+	}
+	if wr.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wr.secret))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get(HeaderWebhookSignature) != want {
+			wr.t.Errorf("signature %q, want %q", req.Header.Get(HeaderWebhookSignature), want)
+		}
+	} else if sig := req.Header.Get(HeaderWebhookSignature); sig != "" {
+		wr.t.Errorf("unsigned webhook has signature %q", sig)
+	}
+	var ev NotifyEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		wr.t.Errorf("webhook body %q: %s", body, err)
+		return
+	}
+	if req.Header.Get(HeaderWebhookEvent) != ev.Event || req.Header.Get(HeaderWebhookDelivery) != ev.ID {
+		wr.t.Errorf("headers %v don't match event %+v", req.Header, ev)
+	}
+	wr.mu.Lock()
+	wr.events = append(wr.events, ev)
+	wr.mu.Unlock()
+}
+
+// take returns the names of events received since the last call, sorted:
+// each is delivered in its own goroutine.
+func (wr *webhookReceiver) take() []string {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	var names []string
+	for _, ev := range wr.events {
+		names = append(names, ev.Event)
+	}
+	wr.events = nil
+	sort.Strings(names)
+	return names
+}
+
+func TestNotifyOutcome(t *testing.T) {
+	const repeat = 300 * time.Millisecond
+	receiver := newWebhookReceiver(t, "")
+	r := newTestRenewer(t, Config{WebhookURLs: []string{receiver.URL}, NotifyRepeat: repeat, ExpiryWarning: time.Hour})
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	longLived := &ocsp.Response{NextUpdate: time.Now().Add(24 * time.Hour)}
+	expiring := &ocsp.Response{NextUpdate: time.Now().Add(30 * time.Minute)}
+	// The CA never gives us more than the expiry warning.
+	shortLived := &ocsp.Response{ThisUpdate: time.Now(), NextUpdate: time.Now().Add(30 * time.Minute)}
+
+	step := func(name string, attempted bool, old, got *ocsp.Response, err error, want ...string) {
+		t.Helper()
+		cr := &CertRenewal{Renewer: r, certPath: "/etc/ssl/site.crt", cert: leaf, attempted: attempted, oldStaple: old, newStaple: got}
+		cr.notifyOutcome(err)
+		r.FlushNotifications()
+		if got := receiver.take(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sent %q, want %q", name, got, want)
+		}
+	}
+
+	step("fine", true, longLived, longLived, nil)
+	step("not checked", false, longLived, nil, nil)
+	step("failing", true, longLived, nil, ErrHTTPFailure, EventFailed)
+	step("still failing", true, longLived, nil, ErrHTTPFailure)
+	step("failing and expiring", true, expiring, nil, ErrHTTPFailure, EventExpiring)
+	time.Sleep(repeat)
+	step("failing after the repeat interval", true, expiring, nil, ErrHTTPFailure, EventFailed, EventExpiring)
+	step("recovered", true, expiring, longLived, nil, EventRecovered)
+	step("still fine", true, longLived, longLived, nil)
+	step("renewed, but the CA gave us an old response", true, longLived, expiring, nil)
+	step("renewed with a short-lived staple", true, longLived, shortLived, nil, EventExpiring)
+	step("and again", true, shortLived, shortLived, nil)
+	time.Sleep(repeat)
+	step("even after the repeat interval", true, shortLived, shortLived, nil)
+	step("unknown", true, longLived, nil, UnknownAtCAError{Cert: leaf}, EventUnknown)
+	step("revoked", true, expiring, nil, RevokedError{Cert: leaf}, EventRevoked)
+	step("no OCSP", false, nil, nil, ErrNoOCSPInCert)
+
+	// A cert forgotten and found again starts with a clean slate.
+	step("failing once more", true, longLived, nil, ErrHTTPFailure, EventFailed)
+	r.certStatus["/etc/ssl/site.crt"] = &CertStatus{Path: "/etc/ssl/site.crt"}
+	if !r.forgetPath("/etc/ssl/site.crt") {
+		t.Fatal("forgetPath: not tracked")
+	}
+	step("found again, still failing", true, longLived, nil, ErrHTTPFailure, EventFailed)
+}
+
+func TestNotifySigned(t *testing.T) {
+	receiver := newWebhookReceiver(t, "s3kr1t")
+	unsigned := newWebhookReceiver(t, "")
+	r := newTestRenewer(t, Config{WebhookURLs: []string{receiver.URL}, WebhookSecret: "s3kr1t"})
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+
+	cr := &CertRenewal{Renewer: r, certPath: "/etc/ssl/site.crt", staplePath: "/var/ocsp/site.ocsp", cert: leaf, attempted: true}
+	cr.notifyOutcome(ErrHTTPFailure)
+	r.FlushNotifications()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.events) != 1 {
+		t.Fatalf("received %d events, want 1", len(receiver.events))
+	}
+	ev := receiver.events[0]
+	if ev.Path != cr.certPath || ev.StaplePath != cr.staplePath || ev.Serial != leaf.SerialNumber.Text(16) || ev.Error != ErrHTTPFailure.Error() || ev.ID == "" {
+		t.Errorf("event %+v doesn't describe the failure", ev)
+	}
+
+	// and without a secret, no signature
+	r = newTestRenewer(t, Config{WebhookURLs: []string{unsigned.URL}})
+	(&CertRenewal{Renewer: r, certPath: "/etc/ssl/site.crt", cert: leaf, attempted: true}).notifyOutcome(ErrHTTPFailure)
+	r.FlushNotifications()
+	if got := unsigned.take(); len(got) != 1 {
+		t.Errorf("unsigned receiver got %q", got)
+	}
+}
@@ -7,10 +7,14 @@ package renew // import "go.pennock.tech/ocsprenewer/renew"
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ocsp"
@@ -25,6 +29,24 @@ const (
 	MIMETypeOCSPRequest = "application/ocsp-request"
 )
 
+// Values for Config.RequestMethod and Config.ResponderMethods
+const (
+	RequestMethodAuto = "auto" // GET if short enough, else POST; the default
+	RequestMethodGet  = "get"
+	RequestMethodPost = "post"
+)
+
+// MaxGetRequestLength is the RFC 5019 limit for an OCSP GET URL, beyond which
+// RequestMethodAuto uses POST.
+const MaxGetRequestLength = 255
+
+// Values for Config.ResponderOrder
+const (
+	ResponderOrderListed   = "listed"    // as in the cert; the default
+	ResponderOrderRandom   = "random"    // spread load across responders
+	ResponderOrderLastGood = "last-good" // start with whichever last worked for this cert
+)
+
 var (
 	ErrCertAlreadyExpired = errors.New("refuse to fetch OCSP staple for expired cert")
 	ErrNoIssuer           = errors.New("unable to find an issuer to validate any OCSP response")
@@ -36,12 +58,27 @@ var (
 
 // We're responsible both for the renewal over the wire and for updating any
 // staple in filesystem.
-func (cr *CertRenewal) renewOneCertNow(rawRestOfChain []byte) error {
+func (cr *CertRenewal) renewOneCertNow(rawRestOfChain []byte) (err error) {
 
-	if len(cr.cert.OCSPServer) < 1 {
+	if len(cr.ocspServers()) < 1 {
 		return ErrNoOCSPInCert
 	}
 
+	// We _always_ set retry timers on failure, rather than forget about the
+	// cert; on success, they're set from the new staple.
+	// The exceptions are revocation and expiry: retrying won't help, so
+	// we're done with this cert until a sweep or the watcher finds it
+	// replaced.
+	defer func() {
+		var revoked RevokedError
+		switch {
+		case errors.As(err, &revoked), err == ErrCertAlreadyExpired:
+			cr.Renewer.unschedule(cr.certPath)
+		case err != nil:
+			cr.setRetryTimersAfterFailure(err)
+		}
+	}()
+
 	if time.Now().After(cr.cert.NotAfter) {
 		return ErrCertAlreadyExpired
 	}
@@ -52,6 +89,9 @@ func (cr *CertRenewal) renewOneCertNow(rawRestOfChain []byte) error {
 	if cr.issuer == nil {
 		cr.issuer = cr.findIssuer()
 	}
+	if cr.issuer == nil {
+		cr.issuer = cr.fetchIssuerViaAIA()
+	}
 	if cr.issuer == nil {
 		return ErrNoIssuer
 	}
@@ -68,6 +108,8 @@ func (cr *CertRenewal) renewOneCertNow(rawRestOfChain []byte) error {
 		return err
 	}
 
+	cr.attempted = true
+
 	staple, rawStaple, err := cr.fetchOCSPviaHTTP(req)
 	if err != nil {
 		if re, ok := err.(ocsp.ResponseError); ok {
@@ -83,32 +125,41 @@ func (cr *CertRenewal) renewOneCertNow(rawRestOfChain []byte) error {
 				// future improved logging.
 			}
 		}
-		// We _always_ set retry timers, rather than forget about the cert
-		cr.setRetryTimersFromStaple(nil)
 		return err
 	}
 	if staple == nil {
 		cr.CertLogf("BUG: have nil OCSP staple but fetch returned success")
 		return ErrOCSPProblem
 	}
+	cr.fetched = staple
 
 	switch staple.Status {
 	case ocsp.Good:
-		cr.CertLogf("OCSP: status=%v sn=%v producedAt=(%s) thisUpdate=(%s) nextUpdate=(%s)",
-			staple.Status, staple.SerialNumber, staple.ProducedAt, staple.ThisUpdate, staple.NextUpdate)
+		cr.CertLogf("OCSP: status=%v sn=%v producedAt=(%s) thisUpdate=(%s) nextUpdate=(%s) from=%q",
+			staple.Status, staple.SerialNumber, staple.ProducedAt, staple.ThisUpdate, staple.NextUpdate, cr.responderURL)
 		// no return
 	case ocsp.Revoked:
-		return RevokedError{Cert: cr.cert, RevokedAt: staple.RevokedAt}
+		return cr.handleRevoked(staple, rawStaple)
 	case ocsp.Unknown:
-		return UnknownAtCAError{Cert: cr.cert, URL: cr.cert.OCSPServer[0]}
+		return UnknownAtCAError{Cert: cr.cert, URL: cr.responderURL, Tried: cr.triedURLs}
 	default:
 		cr.CertLogf("OCSP: unhandled staple status %v", staple.Status)
 		return ErrOCSPProblem
 	}
 
+	if err := cr.validateStaple(staple); err != nil {
+		cr.CertLogf("keeping existing staple: %s", err)
+		return err
+	}
+
 	cr.setRetryTimersFromStaple(staple)
 
-	return cr.writeStaple(staple, rawStaple) // handles permit check itself
+	// handles permit check itself
+	if err := cr.writeStaple(staple, rawStaple); err != nil {
+		return err
+	}
+	cr.newStaple = staple
+	return nil
 }
 
 func (cr *CertRenewal) tryIssuerInRest(rest []byte) *x509.Certificate {
@@ -127,49 +178,208 @@ func (cr *CertRenewal) tryIssuerInRest(rest []byte) *x509.Certificate {
 	return cert
 }
 
-// move this out to something which manages system pools, any CAs specified in
-// cmdline flags, etc.  Should probably have something which builds a map of CA
-// certs (and can be re-triggered based on a certs dir watch) so that can index
-// directly from issuer to cert.
-//
-// Two maps, one keyed by `X509v3 Subject Key Identifier` and for which the
-// entity cert's `X509v3 Authority Key Identifier` is used as the lookup key,
-// and a backup map of Subject DN, with entity cert's Issuer DN used as the
-// lookup key.
+// findIssuer looks in the issuer store, built from any CA certs specified in
+// configuration (and perhaps the system bundle); see issuers.go for the
+// indexing.
 func (cr *CertRenewal) findIssuer() *x509.Certificate {
-	cr.CertLogf("UNIMPLEMENTED findIssuer() path %q", cr.certPath)
-	return nil
+	issuer := cr.Renewer.issuers.lookup(cr.cert)
+	if issuer == nil {
+		cr.CertLogf("no issuer found in store (%d certs)", cr.Renewer.issuers.size())
+	}
+	return issuer
 }
 
-// fetchOCSPviaHTTP fetches the OCSP response.
-// TODO: should we iterate over OCSP URLs?  Does anything actually need that?
-//
-//	if so, also consider construction of UnknownAtCAError object elsewhere
+// fetchOCSPviaHTTP fetches the OCSP response, trying each responder listed
+// in the cert in turn (see responderURLs for the order) until one gives us
+// something usable.  We move on after HTTP-level failures, tryLater and
+// responses which don't parse; any other answer from a responder is final.
+// cr.triedURLs records where we went, cr.responderURL which one answered
+// with a response; an OCSP error, while final, doesn't count.
 func (cr *CertRenewal) fetchOCSPviaHTTP(ocspReq []byte) (*ocsp.Response, []byte, error) {
-	req, err := http.NewRequest(
-		http.MethodPost,
-		cr.cert.OCSPServer[0],
-		bytes.NewReader(ocspReq))
+	var lastErr error
+	for _, u := range cr.responderURLs() {
+		cr.triedURLs = append(cr.triedURLs, u)
+		staple, raw, err := cr.fetchOCSPFrom(u, ocspReq)
+		if err == nil {
+			cr.responderURL = u
+			return staple, raw, nil
+		}
+		if !shouldTryNextResponder(err) {
+			cr.CertLogf("OCSP responder %q refused: %s", u, err)
+			return nil, nil, err
+		}
+		cr.CertLogf("OCSP responder %q failed: %s", u, err)
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+func shouldTryNextResponder(err error) bool {
+	if re, ok := err.(ocsp.ResponseError); ok {
+		return re.Status == ocsp.TryLater
+	}
+	// HTTP failures, network errors and parse failures
+	return true
+}
+
+// ocspServers gives the OCSP URLs from the cert, unless overridden by policy.
+func (cr *CertRenewal) ocspServers() []string {
+	if len(cr.policy.responderURLs) > 0 {
+		return cr.policy.responderURLs
+	}
+	return cr.cert.OCSPServer
+}
+
+// responderURLs gives the OCSP URLs for the cert, in the order to try them.
+func (cr *CertRenewal) responderURLs() []string {
+	servers := cr.ocspServers()
+	urls := make([]string, len(servers))
+	copy(urls, servers)
+
+	switch cr.Renewer.config.ResponderOrder {
+	case ResponderOrderRandom:
+		rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	case ResponderOrderLastGood:
+		last := cr.Renewer.lastGoodResponder(cr.certPath)
+		for i := range urls {
+			if urls[i] == last {
+				copy(urls[1:i+1], urls[:i])
+				urls[0] = last
+				break
+			}
+		}
+	}
+	return urls
+}
+
+// fetchOCSPFrom talks to one responder, using GET or POST per the configured
+// method for that responder.  With RequestMethodAuto we use GET if the request
+// is small enough for RFC 5019, falling back to POST if that fails at HTTP
+// level or gives us junk; a real OCSP answer (even tryLater) is final.
+//
+// The fallback is part of the one fetch: it's done under the same responder
+// slot, and metrics record only the final attempt, labelled with its method.
+func (cr *CertRenewal) fetchOCSPFrom(responderURL string, ocspReq []byte) (*ocsp.Response, []byte, error) {
+	release, err := cr.Renewer.acquireResponderSlot(cr.ctx, responderURL)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer release()
+
+	f := cr.fetchOCSPWithFallback(responderURL, ocspReq)
+	cr.Renewer.metrics.fetchOutcome(f.outcome, f.method)
+	if f.answered {
+		cr.Renewer.metrics.responderLatency(responderURL, f.method, f.latency)
+	}
+	return f.staple, f.raw, f.err
+}
+
+func (cr *CertRenewal) fetchOCSPWithFallback(responderURL string, ocspReq []byte) *ocspFetch {
+	method := cr.Renewer.requestMethodFor(responderURL)
+	if method == RequestMethodPost {
+		return cr.fetchOCSPOnce(responderURL, http.MethodPost, ocspReq)
+	}
+	if method == RequestMethodGet || len(ocspGetURL(responderURL, ocspReq)) < MaxGetRequestLength {
+		f := cr.fetchOCSPOnce(responderURL, http.MethodGet, ocspReq)
+		if f.err == nil || method == RequestMethodGet {
+			return f
+		}
+		if _, ok := f.err.(ocsp.ResponseError); ok {
+			return f
+		}
+		cr.CertLogf("OCSP GET from %q failed, retrying with POST: %s", responderURL, f.err)
+	}
+	return cr.fetchOCSPOnce(responderURL, http.MethodPost, ocspReq)
+}
+
+// ocspGetURL builds the RFC 5019 (and RFC 6960 Appendix A) GET form: the URL
+// encoding of the base64 encoding of the DER request, appended as a path
+// component.  That's standard base64, padding and all, put through
+// QueryEscape so that '+', '/' and '=' become %2B, %2F and %3D: RFC 5019
+// §A.1 does exactly this, and it's what responders expect.  Not base64url,
+// and not PathEscape, which would leave '+' and '=' alone.
+func ocspGetURL(responderURL string, ocspReq []byte) string {
+	if !strings.HasSuffix(responderURL, "/") {
+		responderURL += "/"
+	}
+	return responderURL + url.QueryEscape(base64.StdEncoding.EncodeToString(ocspReq))
+}
+
+// ocspFetch is the result of one HTTP request to an OCSP responder.
+type ocspFetch struct {
+	method   string
+	staple   *ocsp.Response
+	raw      []byte
+	err      error
+	outcome  string        // one of the Fetch* values
+	answered bool          // we got an HTTP response, so latency is meaningful
+	latency  time.Duration // to read the whole response
+}
+
+func (cr *CertRenewal) fetchOCSPOnce(responderURL, method string, ocspReq []byte) *ocspFetch {
+	f := &ocspFetch{method: method, outcome: FetchHTTPFailure}
+	var req *http.Request
+	if method == http.MethodGet {
+		req, f.err = http.NewRequestWithContext(cr.ctx, http.MethodGet, ocspGetURL(responderURL, ocspReq), nil)
+	} else {
+		req, f.err = http.NewRequestWithContext(cr.ctx,
+			http.MethodPost,
+			responderURL,
+			bytes.NewReader(ocspReq))
+		if req != nil {
+			req.Header.Set("Content-Type", MIMETypeOCSPRequest)
+		}
+	}
+	if f.err != nil {
+		return f
+	}
 
+	start := time.Now()
 	resp, err := cr.httpDo(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, nil, err
+		f.err = err
+		return f
 	}
-	raw, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, err
+	f.raw, f.err = io.ReadAll(resp.Body)
+	f.latency = time.Since(start)
+	f.answered = true
+	if f.err != nil {
+		f.raw = nil
+		return f
 	}
 	if resp.StatusCode != http.StatusOK {
-		cr.Logf("HTTP %s response from %q", resp.Status, cr.cert.OCSPServer[0])
-		return nil, nil, ErrHTTPFailure
+		cr.Logf("HTTP %s response from %s %q", resp.Status, method, responderURL)
+		f.raw = nil
+		f.err = ErrHTTPFailure
+		return f
 	}
 
-	r, e := ocsp.ParseResponseForCert(raw, cr.cert, cr.issuer)
-	return r, raw, e
+	f.staple, f.err = ocsp.ParseResponseForCert(f.raw, cr.cert, cr.issuer)
+	f.outcome = fetchOutcomeOf(f.staple, f.err)
+	return f
+}
+
+// fetchOutcomeOf classifies a parsed response (or parse failure) for metrics.
+func fetchOutcomeOf(staple *ocsp.Response, err error) string {
+	if err != nil {
+		if re, ok := err.(ocsp.ResponseError); ok {
+			if re.Status == ocsp.TryLater {
+				return FetchTryLater
+			}
+			return FetchOCSPError
+		}
+		return FetchParseFailure
+	}
+	switch staple.Status {
+	case ocsp.Good:
+		return FetchGood
+	case ocsp.Revoked:
+		return FetchRevoked
+	case ocsp.Unknown:
+		return FetchUnknown
+	}
+	return FetchParseFailure
 }
@@ -0,0 +1,309 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestFetchOCSPFailover(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	r := newTestRenewer(t, Config{})
+
+	fixed := func(status int, body []byte) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write(body)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	good := newTestResponder(t, ca).URL
+	revoked := newTestResponder(t, ca)
+	revoked.answer = func(req *ocsp.Request) []byte {
+		now := time.Now()
+		return ca.ocspResponse(req, ocsp.Response{
+			Status:           ocsp.Revoked,
+			RevokedAt:        now.Add(-time.Hour),
+			RevocationReason: ocsp.KeyCompromise,
+			ThisUpdate:       now.Add(-time.Minute),
+			NextUpdate:       now.Add(time.Hour),
+		})
+	}
+	var (
+		unreachable  = down.URL
+		serverError  = fixed(http.StatusInternalServerError, nil)
+		junk         = fixed(http.StatusOK, []byte("<html>Welcome to nginx!</html>"))
+		tryLater     = fixed(http.StatusOK, ocsp.TryLaterErrorResponse)
+		tryLaterToo  = fixed(http.StatusOK, ocsp.TryLaterErrorResponse)
+		unauthorized = fixed(http.StatusOK, ocsp.UnauthorizedErrorResponse)
+	)
+
+	for _, tc := range []struct {
+		name       string
+		responders []string
+		tried      int
+		answered   string // responderURL afterwards
+		failed     bool
+		status     int   // of the staple, if not failed
+		wantErr    error // if failed, and it matters which error
+	}{
+		{"first is fine", []string{good, serverError}, 1, good, false, ocsp.Good, nil},
+		{"past all kinds of failure", []string{unreachable, serverError, junk, tryLater, good}, 5, good, false, ocsp.Good, nil},
+		{"revoked is definitive", []string{revoked.URL, good}, 1, revoked.URL, false, ocsp.Revoked, nil},
+		{"an OCSP error other than tryLater is definitive", []string{unauthorized, good}, 1, "", true, 0, ocsp.ResponseError{Status: ocsp.Unauthorized}},
+		{"everyone says tryLater", []string{tryLater, tryLaterToo}, 2, "", true, 0, ocsp.ResponseError{Status: ocsp.TryLater}},
+		{"everything broken", []string{serverError, unreachable}, 2, "", true, 0, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			leaf, _ := ca.issue(t, &x509.Certificate{OCSPServer: tc.responders})
+			cr := &CertRenewal{Renewer: r, ctx: context.Background(), certPath: "leaf.crt", policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+			req, err := ocsp.CreateRequest(leaf, ca.cert, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			staple, _, err := cr.fetchOCSPviaHTTP(req)
+			if !reflect.DeepEqual(cr.triedURLs, tc.responders[:tc.tried]) {
+				t.Errorf("tried %q, want %q", cr.triedURLs, tc.responders[:tc.tried])
+			}
+			if cr.responderURL != tc.answered {
+				t.Errorf("answered by %q, want %q", cr.responderURL, tc.answered)
+			}
+			switch {
+			case !tc.failed:
+				if err != nil {
+					t.Fatalf("got error %v, want status %d", err, tc.status)
+				}
+				if staple.Status != tc.status {
+					t.Errorf("status %d, want %d", staple.Status, tc.status)
+				}
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("got error %v, want %v", err, tc.wantErr)
+				}
+			case err == nil:
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestResponderURLs(t *testing.T) {
+	listed := []string{"http://a.example/", "http://b.example/", "http://c.example/"}
+
+	for _, tc := range []struct {
+		order    string
+		lastGood string
+		want     []string
+	}{
+		{ResponderOrderListed, "http://c.example/", listed},
+		{ResponderOrderLastGood, "", listed},
+		{ResponderOrderLastGood, "http://gone.example/", listed},
+		{ResponderOrderLastGood, "http://c.example/", []string{"http://c.example/", "http://a.example/", "http://b.example/"}},
+		{ResponderOrderLastGood, "http://b.example/", []string{"http://b.example/", "http://a.example/", "http://c.example/"}},
+	} {
+		r := newTestRenewer(t, Config{ResponderOrder: tc.order})
+		r.certStatus["leaf.crt"] = &CertStatus{Path: "leaf.crt", Responder: tc.lastGood}
+		cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", policy: r.basePolicy, cert: &x509.Certificate{OCSPServer: listed}}
+		if got := cr.responderURLs(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s order, last good %q: got %q, want %q", tc.order, tc.lastGood, got, tc.want)
+		}
+	}
+
+	r := newTestRenewer(t, Config{ResponderOrder: ResponderOrderRandom})
+	cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", policy: r.basePolicy, cert: &x509.Certificate{OCSPServer: listed}}
+	got := cr.responderURLs()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, listed) {
+		t.Errorf("random order gave %q, not a shuffle of %q", got, listed)
+	}
+}
+
+// A responder which refuses us isn't one to prefer next time.
+func TestLastGoodResponderAfterRefusal(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	first, second := newTestResponder(t, ca), newTestResponder(t, ca)
+	setAnswer := func(tr *testResponder, answer []byte) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		tr.answer = func(*ocsp.Request) []byte { return answer }
+	}
+	setAnswer(second, ocsp.UnauthorizedErrorResponse)
+
+	dir := t.TempDir()
+	path, _ := ca.writeLeaf(t, dir, "leaf.crt", first.URL, second.URL)
+	r := newTestRenewer(t, Config{InputPaths: []string{path}, OutputDir: t.TempDir(), ResponderOrder: ResponderOrderLastGood})
+	ctx := context.Background()
+
+	if _, err := r.RenewPath(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lastGoodResponder(path); got != first.URL {
+		t.Fatalf("last good responder %q, want %q", got, first.URL)
+	}
+
+	setAnswer(first, ocsp.TryLaterErrorResponse)
+	res, err := r.RenewPath(ctx, path)
+	if !errors.Is(err, ocsp.ResponseError{Status: ocsp.Unauthorized}) || res.Responder != "" {
+		t.Fatalf("got %v from %q, want unauthorized from nobody", err, res.Responder)
+	}
+	if got := r.lastGoodResponder(path); got != first.URL {
+		t.Errorf("after a refusal, last good responder %q, want %q still", got, first.URL)
+	}
+	if st, _ := r.certStatusOf(path); st.Responder != first.URL || st.LastResult != ResultFailed {
+		t.Errorf("status responder %q, result %q", st.Responder, st.LastResult)
+	}
+}
+
+func TestOCSPGetURL(t *testing.T) {
+	for _, tc := range []struct {
+		responder string
+		req       []byte
+		want      string
+	}{
+		{"http://ocsp.example", []byte("ocsp"), "http://ocsp.example/b2NzcA%3D%3D"},
+		{"http://ocsp.example/", []byte("ocsp"), "http://ocsp.example/b2NzcA%3D%3D"},
+		{"http://ocsp.example/ca1", []byte("ocsp"), "http://ocsp.example/ca1/b2NzcA%3D%3D"},
+		{"http://ocsp.example/", []byte("abc"), "http://ocsp.example/YWJj"},
+		// Standard base64, URL-escaped, not base64url: see RFC 5019 A.1.
+		{"http://ocsp.example/", []byte{0xfb, 0xff}, "http://ocsp.example/%2B%2F8%3D"},
+	} {
+		if got := ocspGetURL(tc.responder, tc.req); got != tc.want {
+			t.Errorf("ocspGetURL(%q, %x) = %q, want %q", tc.responder, tc.req, got, tc.want)
+		}
+	}
+}
+
+func TestFetchOCSPRequestMethod(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	ocspReq, err := ocsp.CreateRequest(leaf, ca.cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pushes the GET URL past MaxGetRequestLength.
+	longPath := "/" + strings.Repeat("ocsp", MaxGetRequestLength/4)
+
+	for _, tc := range []struct {
+		name      string
+		method    string
+		override  string // for this responder's host
+		postOnly  bool
+		path      string
+		want      []string
+		wantError bool
+	}{
+		{name: "auto uses GET", method: RequestMethodAuto, want: []string{"GET"}},
+		{name: "auto uses POST for long URLs", method: RequestMethodAuto, path: longPath, want: []string{"POST"}},
+		{name: "auto falls back to POST", method: RequestMethodAuto, postOnly: true, want: []string{"GET", "POST"}},
+		{name: "POST only", method: RequestMethodPost, want: []string{"POST"}},
+		{name: "GET only", method: RequestMethodGet, postOnly: true, want: []string{"GET"}, wantError: true},
+		{name: "GET even when long", method: RequestMethodGet, path: longPath, want: []string{"GET"}, wantError: true},
+		{name: "per-host override", method: RequestMethodAuto, override: RequestMethodPost, want: []string{"POST"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			responder := newTestResponder(t, ca)
+			responder.postOnly = tc.postOnly
+			c := Config{RequestMethod: tc.method}
+			if tc.override != "" {
+				c.ResponderMethods = map[string]string{responderHost(responder.URL): tc.override}
+			}
+			r := newTestRenewer(t, c)
+			cr := &CertRenewal{Renewer: r, ctx: context.Background(), certPath: "leaf.crt", cert: leaf, issuer: ca.cert}
+
+			staple, _, err := cr.fetchOCSPFrom(responder.URL+tc.path, ocspReq)
+			if tc.wantError {
+				if err == nil {
+					t.Error("got no error")
+				}
+			} else if err != nil || staple.Status != ocsp.Good {
+				t.Errorf("got %v, want a good staple", err)
+			}
+			if !reflect.DeepEqual(responder.methods, tc.want) {
+				t.Errorf("requests %q, want %q", responder.methods, tc.want)
+			}
+
+			// However many requests it took, that's one fetch, labelled
+			// with the method of the last.
+			last := tc.want[len(tc.want)-1]
+			for key, n := range r.metrics.fetches {
+				if n != 1 || key.method != last {
+					t.Errorf("%d fetches with outcome %q by %s, want 1 by %s", n, key.label, key.method, last)
+				}
+			}
+			if len(r.metrics.fetches) != 1 {
+				t.Errorf("fetches recorded: %v", r.metrics.fetches)
+			}
+		})
+	}
+}
+
+func TestAcquireResponderSlotCancelled(t *testing.T) {
+	r := newTestRenewer(t, Config{PerResponderConcurrency: 1})
+	const responder = "http://ocsp.example/"
+	release, err := r.acquireResponderSlot(context.Background(), responder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the only slot taken, we give up when the cert's context does.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.acquireResponderSlot(ctx, responder); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's error", err)
+	}
+
+	release()
+	release, err = r.acquireResponderSlot(context.Background(), responder)
+	if err != nil {
+		t.Fatalf("after release: %s", err)
+	}
+	release()
+}
+
+func TestExpiredCertUnscheduled(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	leaf, _ := ca.issue(t, &x509.Certificate{
+		OCSPServer: []string{responder.URL},
+		NotBefore:  time.Now().Add(-48 * time.Hour),
+		NotAfter:   time.Now().Add(-time.Hour),
+	})
+	r := newTestRenewer(t, Config{})
+	r.needTimers = true
+	r.RegisterFutureCheck("leaf.crt", time.Now().Add(time.Hour))
+	cr := &CertRenewal{Renewer: r, ctx: context.Background(), certPath: "leaf.crt", policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+
+	// Retrying won't make it any less expired.
+	if err := cr.renewOneCertNow(nil); err != ErrCertAlreadyExpired {
+		t.Fatalf("got %v, want ErrCertAlreadyExpired", err)
+	}
+	if at, ok := r.nextRenew["leaf.crt"]; ok {
+		t.Errorf("expired cert still scheduled, for %s", at)
+	}
+	if requests, _ := responder.counts(); requests != 0 {
+		t.Errorf("%d OCSP requests for an expired cert", requests)
+	}
+
+	r.needTimers = false
+	if next := cr.nextCheck(ErrCertAlreadyExpired); !next.IsZero() {
+		t.Errorf("next check %s for an expired cert", next)
+	}
+}
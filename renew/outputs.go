@@ -0,0 +1,227 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Values for OutputSpec.Layout: where within (or outside) Dir a cert's staple
+// goes.  With flat, certs of the same name in different directories collide.
+const (
+	LayoutFlat   = "flat"   // Dir/name.ext; the default
+	LayoutBeside = "beside" // next to the cert, ignoring Dir
+	LayoutMirror = "mirror" // Dir/<the cert's directory within the inputs>/name.ext
+)
+
+// OutputSpec is one destination for staples.  A fetched response is written
+// to every output; the first is the one we read back to decide on timers.
+// Empty Dir, Extension, Format and Layout fields are taken from the
+// corresponding top-level Config fields.
+type OutputSpec struct {
+	Dir       string
+	Extension string
+	Format    string      // see Format* constants
+	Layout    string      // see Layout* constants
+	Mode      os.FileMode // zero to keep the mode of any existing staple
+	Owner     string      // user name or numeric uid; empty to not change
+	Group     string      // group name or numeric gid; empty to not change
+}
+
+// stapleOutput is an OutputSpec resolved for use
+type stapleOutput struct {
+	OutputSpec
+	format   StapleFormat
+	uid, gid int    // -1 for no change
+	root     string // for LayoutMirror, see inputRoot
+}
+
+// ParseOutputSpec parses the command-line form of an OutputSpec: comma
+// separated key=value pairs, with keys dir, ext, format, layout, mode, owner,
+// group.  A leading element without an = is the dir.
+//
+//	/var/cache/haproxy,ext=.ocsp,mode=0640,group=haproxy
+func ParseOutputSpec(s string) (OutputSpec, error) {
+	var spec OutputSpec
+	for i, field := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			if i != 0 {
+				return spec, fmt.Errorf("output spec %q: expected key=value, got %q", s, field)
+			}
+			k, v = "dir", field
+		}
+		switch k {
+		case "dir":
+			spec.Dir = v
+		case "ext", "extension":
+			spec.Extension = v
+		case "format":
+			spec.Format = v
+		case "layout":
+			spec.Layout = v
+		case "mode":
+			m, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return spec, fmt.Errorf("output spec %q: bad mode: %w", s, err)
+			}
+			spec.Mode = os.FileMode(m)
+		case "owner", "user":
+			spec.Owner = v
+		case "group":
+			spec.Group = v
+		default:
+			return spec, fmt.Errorf("output spec %q: unknown key %q", s, k)
+		}
+	}
+	return spec, nil
+}
+
+// resolveOutputs resolves specs, taking empty fields from defaults; no specs
+// means just the defaults.  root is what mirror layouts are relative to.
+func resolveOutputs(specs []OutputSpec, defaults OutputSpec, root string) ([]*stapleOutput, error) {
+	if len(specs) == 0 {
+		specs = []OutputSpec{{}}
+	}
+
+	outputs := make([]*stapleOutput, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Dir == "" {
+			spec.Dir = defaults.Dir
+		}
+		if spec.Extension == "" {
+			spec.Extension = defaults.Extension
+		}
+		if spec.Format == "" {
+			spec.Format = defaults.Format
+		}
+		if spec.Layout == "" {
+			spec.Layout = defaults.Layout
+		}
+		switch spec.Layout {
+		case "":
+			spec.Layout = LayoutFlat
+		case LayoutFlat, LayoutBeside, LayoutMirror:
+		default:
+			return nil, fmt.Errorf("output %q: unknown layout %q", spec.Dir, spec.Layout)
+		}
+		if spec.Layout != LayoutBeside && !directoryExists(spec.Dir) {
+			return nil, fmt.Errorf("output directory %q does not exist or is not a directory", spec.Dir)
+		}
+
+		out := &stapleOutput{OutputSpec: spec, uid: -1, gid: -1, root: root}
+		var err error
+		if out.format, err = LookupStapleFormat(spec.Format); err != nil {
+			return nil, err
+		}
+		if spec.Owner != "" {
+			if out.uid, err = lookupID(spec.Owner, lookupUID); err != nil {
+				return nil, fmt.Errorf("output %q: owner: %w", spec.Dir, err)
+			}
+		}
+		if spec.Group != "" {
+			if out.gid, err = lookupID(spec.Group, lookupGID); err != nil {
+				return nil, fmt.Errorf("output %q: group: %w", spec.Dir, err)
+			}
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+// pathFor gives where the staple for the cert at certPath goes, given the
+// basename (without extension) to use.
+func (out *stapleOutput) pathFor(certPath, name string) (string, error) {
+	fn := name + out.Extension
+	switch out.Layout {
+	case LayoutBeside:
+		return filepath.Join(filepath.Dir(certPath), fn), nil
+	case LayoutMirror:
+		certDir, err := filepath.Abs(filepath.Dir(certPath))
+		if err != nil {
+			return "", err
+		}
+		rel, ok := pathWithin(out.root, certDir)
+		if !ok {
+			return "", fmt.Errorf("cert %q is not under the input paths, %q, for a mirrored staple", certPath, out.root)
+		}
+		return filepath.Join(out.Dir, rel, fn), nil
+	}
+	return filepath.Join(out.Dir, fn), nil
+}
+
+// inputRoot gives the deepest directory holding all of the input paths: the
+// top of the input tree which the mirror layout recreates.  Each input dir
+// gets its own directory beneath the output dir, unless there's only the one.
+func inputRoot(inputs []string, directories bool) (string, error) {
+	var root string
+	for i, in := range inputs {
+		dir, err := filepath.Abs(in)
+		if err != nil {
+			return "", err
+		}
+		if !directories {
+			dir = filepath.Dir(dir)
+		}
+		if i == 0 {
+			root = dir
+			continue
+		}
+		for {
+			if _, ok := pathWithin(root, dir); ok {
+				break
+			}
+			parent := filepath.Dir(root)
+			if parent == root {
+				// root is / and dir is on another volume
+				return "", fmt.Errorf("input paths %q have no common parent", inputs)
+			}
+			root = parent
+		}
+	}
+	return root, nil
+}
+
+// pathWithin gives p relative to dir, if it's dir or beneath it; both must
+// be absolute and clean.
+func pathWithin(dir, p string) (string, bool) {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	idStr, err := lookup(nameOrID)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(idStr)
+}
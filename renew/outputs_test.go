@@ -0,0 +1,222 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestParseOutputSpec(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    OutputSpec
+		wantErr bool
+	}{
+		{in: "/var/cache/ocsp", want: OutputSpec{Dir: "/var/cache/ocsp"}},
+		{in: "/var/cache/haproxy,ext=.ocsp,mode=0640,group=haproxy",
+			want: OutputSpec{Dir: "/var/cache/haproxy", Extension: ".ocsp", Mode: 0o640, Group: "haproxy"}},
+		{in: "dir=/srv,extension=.der,format=pem,user=www",
+			want: OutputSpec{Dir: "/srv", Extension: ".der", Format: "pem", Owner: "www"}},
+		{in: "format=json", want: OutputSpec{Format: "json"}},
+		{in: "/srv,layout=mirror", want: OutputSpec{Dir: "/srv", Layout: LayoutMirror}},
+		{in: "/srv,mode=0999", wantErr: true},
+		{in: "/srv,colour=blue", wantErr: true},
+		{in: "/srv,/other", wantErr: true},
+	} {
+		got, err := ParseOutputSpec(tc.in)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("ParseOutputSpec(%q) = %+v, want error", tc.in, got)
+		case !tc.wantErr && err != nil:
+			t.Errorf("ParseOutputSpec(%q): %s", tc.in, err)
+		case !tc.wantErr && got != tc.want:
+			t.Errorf("ParseOutputSpec(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestResolveOutputs(t *testing.T) {
+	outDir, otherDir := t.TempDir(), t.TempDir()
+	r := newTestRenewer(t, Config{
+		OutputDir:    outDir,
+		OutputFormat: FormatPEM,
+		Outputs: []OutputSpec{
+			{},
+			{Dir: otherDir, Extension: ".der", Format: FormatDER, Owner: "1234", Group: "5678"},
+		},
+	})
+	if len(r.basePolicy.outputs) != 2 {
+		t.Fatalf("%d outputs, want 2", len(r.basePolicy.outputs))
+	}
+	if got, want := r.basePolicy.outputs[0].OutputSpec, (OutputSpec{Dir: outDir, Extension: ".ocsp", Format: FormatPEM, Layout: LayoutFlat}); got != want {
+		t.Errorf("first output %+v, want %+v from the top-level config", got, want)
+	}
+	if r.basePolicy.outputs[0].uid != -1 || r.basePolicy.outputs[0].gid != -1 {
+		t.Errorf("first output uid/gid %d/%d, want -1/-1 for no change", r.basePolicy.outputs[0].uid, r.basePolicy.outputs[0].gid)
+	}
+	if r.basePolicy.outputs[1].uid != 1234 || r.basePolicy.outputs[1].gid != 5678 {
+		t.Errorf("second output uid/gid %d/%d, want 1234/5678", r.basePolicy.outputs[1].uid, r.basePolicy.outputs[1].gid)
+	}
+
+	for name, spec := range map[string]OutputSpec{
+		"missing directory": {Dir: filepath.Join(outDir, "missing")},
+		"unknown format":    {Format: "xml"},
+		"unknown owner":     {Owner: "no-such-user-here"},
+		"unknown layout":    {Layout: "sideways"},
+	} {
+		c := Config{HTTPUserAgent: "ocsprenewer-test", InputPaths: []string{t.TempDir()}, OutputDir: outDir, TimerT1: 0.5, Outputs: []OutputSpec{spec}}
+		if _, err := New(c); err == nil {
+			t.Errorf("%s: New accepted output %+v", name, spec)
+		}
+	}
+}
+
+func TestOutputPathFor(t *testing.T) {
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		layout   string
+		root     string
+		certPath string
+		want     string // empty for an error
+	}{
+		{LayoutFlat, "/etc/ssl", "/etc/ssl/web/site.crt", "/var/ocsp/site.ocsp"},
+		{LayoutFlat, "/etc/ssl", "certs/site.crt", "/var/ocsp/site.ocsp"},
+		{LayoutBeside, "/etc/ssl", "/etc/ssl/web/site.crt", "/etc/ssl/web/site.ocsp"},
+		{LayoutBeside, "/etc/ssl", "certs/site.crt", "certs/site.ocsp"},
+		{LayoutMirror, "/etc/ssl", "/etc/ssl/web/site.crt", "/var/ocsp/web/site.ocsp"},
+		{LayoutMirror, "/etc/ssl", "/etc/ssl/web/../mail/site.crt", "/var/ocsp/mail/site.ocsp"},
+		{LayoutMirror, "/etc/ssl", "/etc/ssl/site.crt", "/var/ocsp/site.ocsp"},
+		{LayoutMirror, "/", "/etc/ssl/web/site.crt", "/var/ocsp/etc/ssl/web/site.ocsp"},
+		{LayoutMirror, wd, "certs/site.crt", "/var/ocsp/certs/site.ocsp"},
+		{LayoutMirror, "/etc/ssl", "/etc/x509/site.crt", ""},
+		{LayoutMirror, "/etc/ssl", "/etc/ssl-old/site.crt", ""},
+	} {
+		out := &stapleOutput{OutputSpec: OutputSpec{Dir: "/var/ocsp", Extension: ".ocsp", Layout: tc.layout}, root: tc.root}
+		got, err := out.pathFor(tc.certPath, "site")
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%s layout, %q under %q: got %q, want an error", tc.layout, tc.certPath, tc.root, got)
+		case tc.want == "":
+		case err != nil:
+			t.Errorf("%s layout, %q under %q: %s", tc.layout, tc.certPath, tc.root, err)
+		case got != tc.want:
+			t.Errorf("%s layout, %q under %q: got %q, want %q", tc.layout, tc.certPath, tc.root, got, tc.want)
+		}
+	}
+
+	// beside doesn't need the output directory to exist
+	r := newTestRenewer(t, Config{Outputs: []OutputSpec{{Dir: "/nonexistent/ocsp", Layout: LayoutBeside}}})
+	if got := r.basePolicy.outputs[0].Layout; got != LayoutBeside {
+		t.Errorf("layout %q, want %q", got, LayoutBeside)
+	}
+}
+
+func TestWriteStapleToOutputs(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf, _ := ca.issue(t, &x509.Certificate{})
+	now := time.Now()
+	raw := ca.ocspResponse(&ocsp.Request{SerialNumber: leaf.SerialNumber}, ocsp.Response{
+		Status: ocsp.Good, ThisUpdate: now.Add(-time.Minute), NextUpdate: now.Add(time.Hour),
+	})
+	staple, err := ocsp.ParseResponseForCert(raw, leaf, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derDir, pemDir := t.TempDir(), t.TempDir()
+	r := newTestRenewer(t, Config{
+		CertExtensions: ".crt",
+		Outputs: []OutputSpec{
+			{Dir: derDir, Mode: 0o640},
+			{Dir: pemDir, Extension: ".pem", Format: FormatPEM},
+		},
+	})
+	cr := &CertRenewal{Renewer: r, certPath: "/etc/ssl/site.crt", policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+	if err := cr.findStaple(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(derDir, "site.ocsp"), filepath.Join(pemDir, "site.pem")}
+	if len(cr.staplePaths) != 2 || cr.staplePaths[0] != want[0] || cr.staplePaths[1] != want[1] || cr.staplePath != want[0] {
+		t.Fatalf("staple paths %q (primary %q), want %q", cr.staplePaths, cr.staplePath, want)
+	}
+
+	if err := cr.writeStaple(staple, raw); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range want {
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if der, err := r.basePolicy.outputs[i].format.Decode(contents); err != nil || !bytes.Equal(der, raw) {
+			t.Errorf("%q doesn't hold the staple: %v", p, err)
+		}
+	}
+	if fi, err := os.Stat(want[0]); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("%q: mode %v (%v), want 0640", want[0], fi.Mode(), err)
+	}
+
+	// One broken output doesn't stop the others being written.
+	if err := os.RemoveAll(derDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(want[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.writeStaple(staple, raw); err == nil {
+		t.Error("writing to a removed output directory didn't fail")
+	}
+	if _, err := os.Stat(want[1]); err != nil {
+		t.Errorf("second output not written after the first failed: %s", err)
+	}
+
+	// mirror creates the directories it needs
+	mirrorDir := t.TempDir()
+	r = newTestRenewer(t, Config{
+		CertExtensions: ".crt",
+		InputPaths:     []string{"/etc/ssl/web/site.crt", "/etc/ssl/mail/site.crt"},
+		Outputs:        []OutputSpec{{Dir: mirrorDir, Layout: LayoutMirror}},
+	})
+	cr = &CertRenewal{Renewer: r, certPath: "/etc/ssl/web/site.crt", policy: r.basePolicy, cert: leaf, issuer: ca.cert}
+	if err := cr.findStaple(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.writeStaple(staple, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(mirrorDir, "web", "site.ocsp")); err != nil {
+		t.Errorf("mirrored staple not written: %s", err)
+	}
+}
+
+func TestInputRoot(t *testing.T) {
+	for _, tc := range []struct {
+		inputs      []string
+		directories bool
+		want        string
+	}{
+		{[]string{"/etc/ssl/certs"}, true, "/etc/ssl/certs"},
+		{[]string{"/etc/ssl/certs/site.crt"}, false, "/etc/ssl/certs"},
+		{[]string{"/lego/accounts/a/certificates", "/lego/accounts/b/certificates"}, true, "/lego/accounts"},
+		{[]string{"/etc/ssl/web/site.crt", "/etc/ssl/web/other.crt", "/etc/ssl/mail/site.crt"}, false, "/etc/ssl"},
+		{[]string{"/etc/ssl", "/etc/ssl-old"}, true, "/etc"},
+		{[]string{"/etc/ssl/certs", "/etc/ssl"}, true, "/etc/ssl"},
+		{[]string{"/etc/ssl", "/srv/certs"}, true, "/"},
+	} {
+		if got, err := inputRoot(tc.inputs, tc.directories); err != nil || got != tc.want {
+			t.Errorf("inputRoot(%q, %v) = %q, %v; want %q", tc.inputs, tc.directories, got, err, tc.want)
+		}
+	}
+}
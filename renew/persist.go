@@ -5,6 +5,7 @@
 package renew // import "go.pennock.tech/ocsprenewer/renew"
 
 import (
+	"context"
 	"sort"
 	"time"
 )
@@ -15,27 +16,68 @@ const (
 	georatioSpinningLoopBackoff = 2.0
 )
 
-// Start creates a persisting process which keeps renewing all OCSP staples forever.
+// Start creates a persisting process which keeps renewing all OCSP staples
+// until Shutdown is called.
 // It exits with a bool which indicates whether exit was expected or not.
-// The HTTP interface might in future provide a means to request a clean expected exit.
+// If Config.HTTPStatus is set, a status service is started first.
 func (r *Renewer) Start() (status bool) {
+	return r.StartContext(context.Background())
+}
+
+// StartContext is Start, also shutting down when ctx is done.
+func (r *Renewer) StartContext(ctx context.Context) (status bool) {
 	status = false
 	defer func() {
+		r.saveState()
 		r.Logf("exiting persistent sweep, no more timer-based renews")
 	}()
 
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Shutdown()
+		case <-r.stopCtx.Done():
+		}
+	}()
+
 	r.needTimers = true
+	r.started = time.Now()
+
+	if err := r.startHTTPStatus(); err != nil {
+		r.Logf("HTTP status service failed to start: %s", err)
+		return
+	}
+
+	if err := r.startControlSocket(); err != nil {
+		r.Errorf("control socket failed to start: %s", err)
+		return
+	}
+
+	if err := r.loadState(); err != nil {
+		r.Logf("unable to restore state, starting afresh: %s", err)
+	}
+
+	if r.config.Directories && r.config.Watch {
+		if err := r.startWatching(); err != nil {
+			r.Logf("unable to watch directories, relying on timers and signals: %s", err)
+		}
+	}
 
 	err := r.OneShot()
 	if err != nil {
 		r.Logf("First sweep errored: %s", err)
 	}
 
-	r.config.Immediate = false
+	_ = r.SetImmediate(false)
 
 	previousLoopStartTime := time.Now()
 	var spinningLoopBackoff time.Duration
 	for {
+		r.saveState()
+		if r.stopping() {
+			break
+		}
+
 		r.renewMutex.Lock()
 		firstRenewal := r.earliestNextRenew
 		r.renewMutex.Unlock()
@@ -47,7 +89,7 @@ func (r *Renewer) Start() (status bool) {
 			emptyTimers = true
 			d := retryJitter(SweepIntervalTimerless)
 			if r.permitRemoteComms {
-				r.Logf("BAD: no scheduled renew checks found; will sleep for %v", d)
+				r.Warnf("BAD: no scheduled renew checks found; will sleep for %v", d)
 			} else {
 				r.Logf("remote comms disabled, unable to get timers; assuming you're testing; will sleep for %v", d)
 			}
@@ -59,7 +101,9 @@ func (r *Renewer) Start() (status bool) {
 			spinningLoopBackoff = minSpinningLoopBackoff
 		} else if now.Sub(previousLoopStartTime) < spinningLoopBackoff {
 			r.Logf("CPU-protection: sleeping for %v", spinningLoopBackoff)
-			time.Sleep(spinningLoopBackoff)
+			if !r.sleepUnlessStopping(spinningLoopBackoff) {
+				continue
+			}
 			now = time.Now()
 			spinningLoopBackoff *= georatioSpinningLoopBackoff
 			if spinningLoopBackoff > maxSpinningLoopBackoff {
@@ -71,9 +115,8 @@ func (r *Renewer) Start() (status bool) {
 		previousLoopStartTime = now
 
 		if firstRenewal.After(now) {
-			// FUTURE: with a service HTTP port and requested exit, or better
-			// signal handling, or dynamic pickup via notify watch, we'd have a
-			// select{} block here, but for now keep it simple.
+			// The sleep is interrupted by signals, by the directory watcher
+			// and by Shutdown.
 			d := firstRenewal.Sub(now)
 			r.Logf("persist-sleep: next renewal at %s, sleeping %s", firstRenewal, d)
 			r.sleepUnlessInterrupted(d)
@@ -83,16 +126,26 @@ func (r *Renewer) Start() (status bool) {
 			// explained below, just before the Evil Goto
 			r.sleepUnlessInterrupted(2 * minSpinningLoopBackoff)
 		}
+		if r.stopping() {
+			continue
+		}
+
+		// A reload may queue a sweep, so comes first.
+		r.applyPendingReload()
+
+		// Changed certs found by the watcher get looked at whatever else
+		// happens in this pass.
+		r.renewPendingPaths()
 
 		if t, full := r.forcedSweepCheck(); !t.IsZero() {
 			if full {
-				r.config.Immediate = true
+				_ = r.SetImmediate(true)
 			}
 			err := r.OneShot()
 			if err != nil {
 				r.Logf("forced full sweep errored: %s", err)
 			}
-			r.config.Immediate = false
+			_ = r.SetImmediate(false)
 			r.forcedSweepResetFor(t)
 		} else if emptyTimers {
 			err := r.OneShot()
@@ -127,6 +180,9 @@ func (r *Renewer) Start() (status bool) {
 		}
 		continue
 	}
+
+	r.finishShutdown()
+	return true
 }
 
 type timePath struct {
@@ -170,7 +226,7 @@ func (r *Renewer) runTimerBasedChecks() error {
 	timePaths = r.getTimePaths()
 	sort.Slice(timePaths, func(i, j int) bool { return timePaths[i].T.Before(timePaths[j].T) })
 	r.renewMutex.Lock()
-	if timePaths[0].T.Before(r.earliestNextRenew) {
+	if len(timePaths) > 0 && timePaths[0].T.Before(r.earliestNextRenew) {
 		r.earliestNextRenew = timePaths[0].T
 	}
 	r.renewMutex.Unlock()
@@ -0,0 +1,198 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// CertPolicy overrides the global settings for the certs it matches.  Zero
+// values inherit from the Config, or from earlier matching policies: all
+// matching policies apply, in order, so put the more specific ones later.
+//
+// Without its own Outputs, a policy's OutputDir, Extension and OutputLayout
+// apply to the Config's Outputs, filling in what those leave empty; where an
+// output sets the field itself, the policy's value couldn't take effect, so
+// that's rejected as an error.
+type CertPolicy struct {
+	// Match is a cert file path, a glob (per filepath.Match) or a directory,
+	// which matches all certs beneath it.
+	Match string
+
+	TimerT1           float64
+	OutputDir         string
+	Extension         string
+	OutputLayout      string
+	Outputs           []OutputSpec // empty fields are taken from this policy's OutputDir, Extension and OutputLayout, else the Config's
+	AllowNonOCSPInDir *bool
+	ResponderURLs     []string // used instead of the OCSP URLs in the cert
+	Hooks             []string // nil to inherit; empty to run no hooks
+}
+
+// certPolicy is what applies to one cert, after resolving all CertPolicy
+// overrides.  It is shared and must not be modified.
+type certPolicy struct {
+	timerT1           float64
+	outputs           []*stapleOutput // never empty
+	allowNonOCSPInDir bool
+	responderURLs     []string
+	hooks             []string
+}
+
+// policyBlock is a CertPolicy resolved at startup
+type policyBlock struct {
+	CertPolicy
+	absMatch string
+	outputs  []*stapleOutput // nil unless this block changes outputs
+}
+
+func (s *settings) resolvePolicies() error {
+	root, err := inputRoot(s.config.InputPaths, s.config.Directories)
+	if err != nil {
+		return err
+	}
+	base := &certPolicy{
+		timerT1:           s.config.TimerT1,
+		allowNonOCSPInDir: s.config.AllowNonOCSPInDir,
+		hooks:             s.config.Hooks,
+	}
+	base.outputs, err = resolveOutputs(s.config.Outputs, OutputSpec{
+		Dir:       s.config.OutputDir,
+		Extension: s.config.Extension,
+		Format:    s.config.OutputFormat,
+		Layout:    s.config.OutputLayout,
+	}, root)
+	if err != nil {
+		return err
+	}
+	s.basePolicy = base
+
+	s.policies = make([]*policyBlock, 0, len(s.config.Policies))
+	for _, p := range s.config.Policies {
+		if p.Match == "" {
+			return errors.New("cert policy without a match")
+		}
+		b := &policyBlock{CertPolicy: p}
+		if b.absMatch, err = filepath.Abs(p.Match); err != nil {
+			return err
+		}
+		if _, err = filepath.Match(b.absMatch, ""); err != nil {
+			return fmt.Errorf("cert policy %q: %w", p.Match, err)
+		}
+		if p.TimerT1 != 0 {
+			if b.TimerT1, err = normaliseTimerT1(p.TimerT1); err != nil {
+				return fmt.Errorf("cert policy %q: %w", p.Match, err)
+			}
+			if t2 := effectiveTimerT2(s.config.TimerT2); b.TimerT1 >= t2 {
+				return fmt.Errorf("cert policy %q: timer T1 (%v) must be before T2 (%v)", p.Match, b.TimerT1, t2)
+			}
+		}
+		if p.OutputDir != "" || p.Extension != "" || p.OutputLayout != "" || len(p.Outputs) > 0 {
+			defaults := OutputSpec{Dir: p.OutputDir, Extension: p.Extension, Format: s.config.OutputFormat, Layout: p.OutputLayout}
+			if defaults.Dir == "" {
+				defaults.Dir = s.config.OutputDir
+			}
+			if defaults.Extension == "" {
+				defaults.Extension = s.config.Extension
+			}
+			if defaults.Layout == "" {
+				defaults.Layout = s.config.OutputLayout
+			}
+			specs := p.Outputs
+			if len(specs) == 0 {
+				specs = s.config.Outputs
+				for _, spec := range specs {
+					if err := checkInheritedOutput(p, spec); err != nil {
+						return fmt.Errorf("cert policy %q: %w", p.Match, err)
+					}
+				}
+			}
+			if b.outputs, err = resolveOutputs(specs, defaults, root); err != nil {
+				return fmt.Errorf("cert policy %q: %w", p.Match, err)
+			}
+		}
+		s.policies = append(s.policies, b)
+	}
+	return nil
+}
+
+// checkInheritedOutput makes sure that the policy's output settings can
+// apply to spec, one of the Config's Outputs which the policy inherits.
+func checkInheritedOutput(p CertPolicy, spec OutputSpec) error {
+	conflict := func(setting, value, own string) error {
+		return fmt.Errorf("%s %q can't apply to output %q, which sets its own %q; give the policy its own outputs", setting, value, spec.Dir, own)
+	}
+	switch {
+	case p.OutputDir != "" && spec.Dir != "":
+		return conflict("out-dir", p.OutputDir, spec.Dir)
+	case p.Extension != "" && spec.Extension != "":
+		return conflict("extension", p.Extension, spec.Extension)
+	case p.OutputLayout != "" && spec.Layout != "":
+		return conflict("layout", p.OutputLayout, spec.Layout)
+	}
+	return nil
+}
+
+func (b *policyBlock) matches(absPath string) bool {
+	if absPath == b.absMatch {
+		return true
+	}
+	if ok, _ := filepath.Match(b.absMatch, absPath); ok {
+		return true
+	}
+	return strings.HasPrefix(absPath, b.absMatch+string(filepath.Separator))
+}
+
+// policyFor resolves the policy for the cert at path p.
+func (r *Renewer) policyFor(p string) *certPolicy {
+	if len(r.policies) == 0 {
+		return r.basePolicy
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return r.basePolicy
+	}
+
+	cp := *r.basePolicy
+	for _, b := range r.policies {
+		if !b.matches(absPath) {
+			continue
+		}
+		if b.TimerT1 != 0 {
+			cp.timerT1 = b.TimerT1
+		}
+		if b.outputs != nil {
+			cp.outputs = b.outputs
+		}
+		if b.AllowNonOCSPInDir != nil {
+			cp.allowNonOCSPInDir = *b.AllowNonOCSPInDir
+		}
+		if len(b.ResponderURLs) > 0 {
+			cp.responderURLs = b.ResponderURLs
+		}
+		if b.Hooks != nil {
+			cp.hooks = b.Hooks
+		}
+	}
+	return &cp
+}
+
+// normaliseTimerT1 accepts either a ratio or a percentage.
+func normaliseTimerT1(t1 float64) (float64, error) {
+	if 1 <= t1 && t1 <= 100 {
+		// Handle percentages on cmdline, instead of ratios
+		t1 = t1 / 100.0
+	}
+	if t1 < 0.1 {
+		return 0, errors.New("timer T1 set too small (10% minimum)")
+	}
+	if t1 > 0.95 {
+		return 0, errors.New("timer T1 set too large (95% maximum)")
+	}
+	return t1, nil
+}
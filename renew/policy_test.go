@@ -0,0 +1,125 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyFor(t *testing.T) {
+	globalDir, webDir := t.TempDir(), t.TempDir()
+	r := newTestRenewer(t, Config{
+		OutputDir: globalDir,
+		Hooks:     []string{"reload all"},
+		Policies: []CertPolicy{
+			{Match: "/etc/ssl/web", OutputDir: webDir, Hooks: []string{"reload web"}},
+			{Match: "/etc/ssl/*/internal-*.crt", TimerT1: 80, ResponderURLs: []string{"http://ocsp.internal.example/"}},
+			{Match: "/etc/ssl/web/quiet.crt", Hooks: []string{}},
+		},
+	})
+
+	for _, tc := range []struct {
+		path      string
+		timerT1   float64
+		dir       string
+		responder []string
+		hooks     []string
+	}{
+		{"/etc/ssl/mail/site.crt", 0.5, globalDir, nil, []string{"reload all"}},
+		{"/etc/ssl/web/site.crt", 0.5, webDir, nil, []string{"reload web"}},
+		{"/etc/ssl/website/site.crt", 0.5, globalDir, nil, []string{"reload all"}},
+		{"/etc/ssl/mail/internal-a.crt", 0.8, globalDir, []string{"http://ocsp.internal.example/"}, []string{"reload all"}},
+		{"/etc/ssl/web/internal-a.crt", 0.8, webDir, []string{"http://ocsp.internal.example/"}, []string{"reload web"}},
+		{"/etc/ssl/web/quiet.crt", 0.5, webDir, nil, []string{}},
+	} {
+		p := r.policyFor(tc.path)
+		if p.timerT1 != tc.timerT1 {
+			t.Errorf("%s: timer T1 %v, want %v", tc.path, p.timerT1, tc.timerT1)
+		}
+		if len(p.outputs) != 1 || p.outputs[0].Dir != tc.dir {
+			t.Errorf("%s: outputs %+v, want just %q", tc.path, p.outputs, tc.dir)
+		}
+		if !reflect.DeepEqual(p.responderURLs, tc.responder) {
+			t.Errorf("%s: responders %q, want %q", tc.path, p.responderURLs, tc.responder)
+		}
+		if !reflect.DeepEqual(p.hooks, tc.hooks) {
+			t.Errorf("%s: hooks %q, want %q", tc.path, p.hooks, tc.hooks)
+		}
+	}
+
+	if r := newTestRenewer(t, Config{}); r.policyFor("/etc/ssl/mail/site.crt") != r.basePolicy {
+		t.Error("without policies, certs should share the base policy")
+	}
+}
+
+func TestResolvePoliciesErrors(t *testing.T) {
+	for name, p := range map[string]CertPolicy{
+		"no match":           {OutputDir: "/tmp"},
+		"bad glob":           {Match: "/etc/ssl/[web"},
+		"T1 too small":       {Match: "/etc/ssl", TimerT1: 0.05},
+		"T1 too large":       {Match: "/etc/ssl", TimerT1: 99},
+		"T1 at T2":           {Match: "/etc/ssl", TimerT1: 0.85},
+		"T1 past T2":         {Match: "/etc/ssl", TimerT1: 90},
+		"missing output dir": {Match: "/etc/ssl", OutputDir: "/nonexistent/ocsp"},
+	} {
+		c := Config{HTTPUserAgent: "ocsprenewer-test", InputPaths: []string{t.TempDir()}, OutputDir: t.TempDir(), TimerT1: 0.5, Policies: []CertPolicy{p}}
+		if _, err := New(c); err == nil {
+			t.Errorf("%s: New accepted policy %+v", name, p)
+		}
+	}
+
+	// T2 is the default unless set; a later one makes room for a later T1.
+	c := Config{HTTPUserAgent: "ocsprenewer-test", InputPaths: []string{t.TempDir()}, OutputDir: t.TempDir(), TimerT1: 0.9}
+	if _, err := New(c); err == nil {
+		t.Errorf("New accepted T1 %v with the default T2 of %v", c.TimerT1, DefaultTimerT2)
+	}
+	c.TimerT1, c.TimerT2 = 0.5, 0.95
+	c.Policies = []CertPolicy{{Match: "/etc/ssl", TimerT1: 0.9}}
+	if _, err := New(c); err != nil {
+		t.Errorf("policy T1 0.9 with T2 0.95: %s", err)
+	}
+}
+
+func TestPolicyInheritedOutputs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+
+	r := newTestRenewer(t, Config{
+		Outputs:  []OutputSpec{{Dir: dirA}, {Dir: dirB, Extension: ".der"}},
+		Policies: []CertPolicy{{Match: "/etc/ssl/web", OutputLayout: LayoutMirror}},
+	})
+	p := r.policyFor("/etc/ssl/web/site.crt")
+	for i, want := range []string{".ocsp", ".der"} {
+		if out := p.outputs[i]; out.Extension != want || out.Layout != LayoutMirror {
+			t.Errorf("output %q: extension %q, layout %q; want %q and the policy's %q", out.Dir, out.Extension, out.Layout, want, LayoutMirror)
+		}
+	}
+
+	outputs := []OutputSpec{{Dir: dirA}, {Dir: dirB, Extension: ".der", Layout: LayoutFlat}}
+	for _, tc := range []struct {
+		name   string
+		policy CertPolicy
+	}{
+		{"out-dir", CertPolicy{Match: "/etc/ssl/web", OutputDir: t.TempDir()}},
+		{"extension", CertPolicy{Match: "/etc/ssl/web", Extension: ".ocsp"}},
+		{"layout", CertPolicy{Match: "/etc/ssl/web", OutputLayout: LayoutMirror}},
+	} {
+		c := r.config
+		c.Outputs = outputs
+		c.Policies = []CertPolicy{tc.policy}
+		_, err := r.newSettings(c)
+		if err == nil || !strings.Contains(err.Error(), tc.name) {
+			t.Errorf("%s: got %v, want an error about the policy's %s", tc.name, err, tc.name)
+		}
+
+		// Fine with outputs of its own.
+		tc.policy.Outputs = []OutputSpec{{Dir: dirA}}
+		c.Policies = []CertPolicy{tc.policy}
+		if _, err := r.newSettings(c); err != nil {
+			t.Errorf("%s with its own outputs: %s", tc.name, err)
+		}
+	}
+}
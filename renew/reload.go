@@ -0,0 +1,117 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Reload replaces the configuration of a persistent run with c.  It is
+// validated as by New, and if that fails the error is returned and the
+// running configuration is kept.  Otherwise the persist loop picks it up
+// before its next pass: the directory watcher is restarted on the new input
+// paths, certs no longer covered by those are dropped from the schedule, and
+// a sweep (per timers) adds any new ones; if nothing changed, only the
+// issuers are reloaded.
+//
+// Logging, HTTPStatus, ControlSocket and StateFile are not changed by a
+// reload.  When not in a persistent run, the new configuration applies at
+// once.
+func (r *Renewer) Reload(c Config) error {
+	r.configMutex.RLock()
+	c.LogHandler = r.config.LogHandler
+	c.Immediate = r.config.Immediate
+	prev := r.config
+	r.configMutex.RUnlock()
+
+	s, err := r.newSettings(c)
+	if err != nil {
+		return err
+	}
+	if c.HTTPStatus != prev.HTTPStatus {
+		r.Warnf("reload: HTTP status service stays on %q until restart", prev.HTTPStatus)
+	}
+	if c.ControlSocket != prev.ControlSocket {
+		r.Warnf("reload: control socket stays at %q until restart", prev.ControlSocket)
+	}
+	if c.StateFile != prev.StateFile {
+		r.Warnf("reload: state file stays as %q until restart", prev.StateFile)
+	}
+	s.config.HTTPStatus = prev.HTTPStatus
+	s.config.ControlSocket = prev.ControlSocket
+	s.config.StateFile = prev.StateFile
+
+	if !r.needTimers {
+		r.applySettings(s)
+		return nil
+	}
+
+	r.renewMutex.Lock()
+	r.pendingReload = s
+	r.renewMutex.Unlock()
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// applyPendingReload is called by the persist loop, between sweeps, so that
+// nothing is using what's replaced.
+func (r *Renewer) applyPendingReload() {
+	r.renewMutex.Lock()
+	s := r.pendingReload
+	r.pendingReload = nil
+	r.renewMutex.Unlock()
+	if s == nil {
+		return
+	}
+
+	// A SIGHUP may only be for log rotation: if nothing changed, we've no
+	// need to disturb the watcher or sweep.  The issuers are still reloaded.
+	if reflect.DeepEqual(s.config, r.config) {
+		r.applySettings(s)
+		r.LogAtf(1, "reload: configuration unchanged")
+		return
+	}
+
+	r.stopWatching()
+	// Queued hooks would otherwise run with the new settings.
+	r.FlushHooks()
+
+	r.applySettings(s)
+
+	if r.config.Directories && r.config.Watch {
+		if err := r.startWatching(); err != nil {
+			r.Warnf("reload: unable to watch directories, relying on timers and signals: %s", err)
+		}
+	}
+
+	for _, p := range r.trackedPaths() {
+		if !r.coveredByInputs(p) {
+			r.forgetPath(p)
+		}
+	}
+	r.forceAddCheck(sweepReq{T: time.Now()})
+	r.Logf("reload: now using %d input paths", len(r.config.InputPaths))
+}
+
+// coveredByInputs says whether the cert at p is one which the configured
+// input paths lead to.
+func (r *Renewer) coveredByInputs(p string) bool {
+	clean := filepath.Clean(p)
+	for _, in := range r.config.InputPaths {
+		if r.config.Directories {
+			if filepath.Dir(clean) == filepath.Clean(in) && r.isCertCandidate(clean) {
+				return true
+			}
+		} else if clean == filepath.Clean(in) {
+			return true
+		}
+	}
+	return false
+}
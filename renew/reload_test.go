@@ -0,0 +1,297 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadPersistent(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	oldCert, _ := ca.writeLeaf(t, oldDir, "old.crt", responder.URL)
+	newCert, _ := ca.writeLeaf(t, newDir, "new.crt", responder.URL)
+	out := t.TempDir()
+
+	c := Config{Directories: true, InputPaths: []string{oldDir}, OutputDir: out}
+	r := newTestRenewer(t, c)
+	c = r.config // with the defaults filled in
+	done := make(chan bool)
+	go func() { done <- r.Start() }()
+	defer func() {
+		r.Shutdown()
+		<-done
+	}()
+
+	// Waits for the sweep to have dealt with just the cert at want.
+	waitTracked := func(want string) {
+		t.Helper()
+		staple := filepath.Join(out, filepath.Base(want)+".ocsp")
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := r.trackedPaths()
+			_, err := os.Stat(staple)
+			if err == nil && reflect.DeepEqual(got, []string{want}) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("tracking %q, want %q; staple: %v", got, want, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitTracked(oldCert)
+
+	bad := c
+	bad.InputPaths = []string{newDir}
+	bad.TimerT1 = 1.5
+	if err := r.Reload(bad); err == nil {
+		t.Fatal("reload with a bad T1 accepted")
+	}
+
+	c.InputPaths = []string{newDir}
+	if err := r.Reload(c); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	waitTracked(newCert)
+}
+
+func TestReloadNotPersistent(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenewer(t, Config{InputPaths: []string{filepath.Join(dir, "a.crt")}})
+	c := r.config
+	c.Directories, c.InputPaths, c.Concurrency = true, []string{dir}, 4
+	if err := r.Reload(c); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+
+	// Applied at once, with what New derives from it.
+	if cap(r.workSlots) != 4 {
+		t.Errorf("%d work slots, want 4", cap(r.workSlots))
+	}
+	for p, want := range map[string]bool{
+		filepath.Join(dir, "b.crt"):           true,
+		filepath.Join(dir, "sub", "b.crt"):    false,
+		filepath.Join(dir, "b.key"):           false,
+		filepath.Join(dir, "..", "other.crt"): false,
+	} {
+		if got := r.coveredByInputs(p); got != want {
+			t.Errorf("coveredByInputs(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestWorkSlotsReplacedDuringWork(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	slow := newTestResponder(t, ca)
+	slow.delay = 200 * time.Millisecond
+	in := t.TempDir()
+	path, _ := ca.writeLeaf(t, in, "leaf.crt", slow.URL)
+	r := newTestRenewer(t, Config{InputPaths: []string{in}})
+
+	done := make(chan error)
+	go func() {
+		_, err := r.RenewPath(context.Background(), path)
+		done <- err
+	}()
+	for {
+		if _, maxInFlight := slow.counts(); maxInFlight > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// As applyReload does, for a new Concurrency.
+	r.workSlots = make(chan struct{}, 2)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RenewPath: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RenewPath stuck releasing its work slot")
+	}
+	if n := len(r.workSlots); n != 0 {
+		t.Errorf("%d of the new work slots taken with nothing running", n)
+	}
+}
+
+// Meant for -race: a reload outside the persist loop mustn't change settings
+// under the feet of renewals and status requests.
+func TestReloadConcurrentReaders(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	responder.delay = 5 * time.Millisecond
+	in := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.crt", "b.crt", "c.crt"} {
+		p, _ := ca.writeLeaf(t, in, name, responder.URL)
+		paths = append(paths, p)
+	}
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{in}})
+	base := r.config
+	status := httptest.NewServer(r.HTTPHandler())
+	t.Cleanup(status.Close)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, p := range paths {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := r.RenewPath(context.Background(), p); err != nil {
+					t.Errorf("RenewPath(%q): %s", p, err)
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := http.Get(status.URL + "/status")
+			if err != nil {
+				t.Errorf("status: %s", err)
+				return
+			}
+			_ = resp.Body.Close()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		c := base
+		c.Concurrency = 1 + i%3
+		c.TimerT1 = 0.5 + float64(i%2)/10
+		c.HTTPUserAgent = fmt.Sprintf("ocsprenewer-test/%d", i)
+		if err := r.Reload(c); err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := r.statusSummary().UserAgent; got != "ocsprenewer-test/19" {
+		t.Errorf("user agent %q after the last reload", got)
+	}
+}
+
+// Meant for -race: forced full sweeps flip Immediate, which a reload from
+// the signal handler or a control client reads.
+func TestReloadDuringForcedSweeps(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	dir := t.TempDir()
+	ca.writeLeaf(t, dir, "leaf.crt", newTestResponder(t, ca).URL)
+	r, _ := startControlled(t, dir)
+	r.configMutex.RLock()
+	c := r.config
+	r.configMutex.RUnlock()
+
+	stop := time.Now().Add(200 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for time.Now().Before(stop) {
+			r.ForceCheckSoon(true)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for time.Now().Before(stop) {
+		if err := r.Reload(c); err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+	}
+	<-done
+}
+
+func TestReloadUnchanged(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	dir := t.TempDir()
+	leafPath, _ := ca.writeLeaf(t, dir, "leaf.crt", newTestResponder(t, ca).URL)
+	r := newTestRenewer(t, Config{Directories: true, Watch: true, InputPaths: []string{dir}})
+	c := r.config
+	done := make(chan bool)
+	go func() { done <- r.Start() }()
+	defer func() {
+		r.Shutdown()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(r.trackedPaths(), []string{leafPath}) {
+		if time.Now().After(deadline) {
+			t.Fatal("first sweep not done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Safe to read: the watcher is started before the first sweep.
+	watcher := r.watcher
+	if watcher == nil {
+		t.Fatal("no directory watcher")
+	}
+
+	reloaded := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			r.renewMutex.Lock()
+			pending := r.pendingReload != nil
+			r.renewMutex.Unlock()
+			if !pending {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("reload not applied")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// As for a SIGHUP which was only meant to reopen the log file.
+	if err := r.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	reloaded()
+	select {
+	case <-watcher.done:
+		t.Error("watcher restarted by a reload which changed nothing")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if at, _ := r.forcedSweepCheck(); !at.IsZero() {
+		t.Error("sweep queued by a reload which changed nothing")
+	}
+
+	c.Hooks = []string{"true"}
+	if err := r.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-watcher.done:
+	case <-time.After(5 * time.Second):
+		t.Error("watcher not restarted by a reload which changed the config")
+	}
+}
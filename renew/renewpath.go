@@ -0,0 +1,130 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RenewResult reports what RenewPath did for one cert.  Fields are left zero
+// where we didn't get that far: eg, Cert is nil if the file couldn't be read.
+type RenewResult struct {
+	Path   string
+	Cert   *x509.Certificate
+	Issuer *x509.Certificate
+
+	Responder string   // the OCSP responder which gave us a response, if any
+	Tried     []string // every OCSP responder we tried, in order
+
+	// Response is the parsed response from Responder, whatever its status
+	// and whether or not it passed validation; Previous is the staple which
+	// was already on disk, if any was usable.
+	Response *ocsp.Response
+	Previous *ocsp.Response
+
+	Outcome     string   // one of the Result* values
+	Written     bool     // at least one staple file was written
+	StaplePath  string   // of the primary output
+	StaplePaths []string // one per output, StaplePath first
+
+	// NextCheck is when the cert should next be checked: per the schedule in
+	// a persistent run, else per the timers from the staple we now have, or
+	// the first retry interval after a failure.  Zero if revoked or expired.
+	NextCheck time.Time
+
+	// Err is nil on success.  Otherwise, test it with errors.As for
+	// RevokedError, UnknownAtCAError and RejectedStapleError, and with
+	// errors.Is for the Err* values, ocsp.ResponseError and the context
+	// errors.
+	Err error
+}
+
+// RenewPath renews the cert at path now, ignoring timers, with network
+// requests made under ctx, and reports what happened.  Unlike a sweep, it
+// checks again even a cert we've been told is revoked.  The result is never
+// nil, and the error returned is its Err.
+//
+// This works on any Renewer from New, whether or not it is in a persistent
+// run; if it is, the cert's schedule and status are updated, just as for
+// certs found by sweeps.  Hooks are queued as usual: outside a persistent
+// run, call FlushHooks to run them.
+func (r *Renewer) RenewPath(ctx context.Context, path string) (*RenewResult, error) {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
+	return r.renewPath(ctx, path)
+}
+
+// renewPath is RenewPath for callers already holding configMutex, or in the
+// persist loop.
+func (r *Renewer) renewPath(ctx context.Context, path string) (*RenewResult, error) {
+	// Shutdown abandons this request too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(r.abandonCtx, cancel)
+	defer stop()
+
+	cr, err := r.handleCertContext(ctx, path, true, true)
+	result := &RenewResult{Path: path, Err: err, Outcome: ResultFailed}
+	if cr == nil {
+		return result, err
+	}
+
+	result.Cert = cr.cert
+	result.Issuer = cr.issuer
+	result.Responder = cr.responderURL
+	result.Tried = cr.triedURLs
+	result.Response = cr.fetched
+	result.Previous = cr.oldStaple
+	result.Outcome = cr.outcome(err)
+	result.Written = cr.written
+	result.StaplePath = cr.staplePath
+	result.StaplePaths = cr.staplePaths
+	result.NextCheck = cr.nextCheck(err)
+	return result, err
+}
+
+// nextCheck says when the cert should next be checked, after handling ended
+// with err.  Outside a persistent run nothing is scheduled, so we work out
+// what would have been.
+func (cr *CertRenewal) nextCheck(err error) time.Time {
+	r := cr.Renewer
+	var revoked RevokedError
+	if errors.As(err, &revoked) || err == ErrCertAlreadyExpired {
+		return time.Time{}
+	}
+	if r.NeedTimers() {
+		r.renewMutex.Lock()
+		defer r.renewMutex.Unlock()
+		return r.nextRenew[cr.certPath]
+	}
+
+	now := time.Now()
+	staple := cr.newStaple
+	if staple == nil {
+		staple = cr.oldStaple
+	}
+	if err != nil {
+		if r.inDanger(staple, now) {
+			return now.Add(r.retryInDanger())
+		}
+		retryAt := now.Add(r.retryBackoff(1))
+		if t2 := validityPoint(staple, r.timerT2()); !staple.ProducedAt.IsZero() && retryAt.After(t2) {
+			retryAt = t2
+		}
+		return retryAt
+	}
+	if staple == nil || staple.NextUpdate.IsZero() || staple.ProducedAt.IsZero() {
+		return now.Add(RetryMissingTimers)
+	}
+	if t1 := validityPoint(staple, cr.policy.timerT1); t1.After(now) {
+		return t1
+	}
+	return now.Add(RetryAfterT1)
+}
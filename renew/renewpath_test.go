@@ -0,0 +1,141 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRenewPath(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	good := newTestResponder(t, ca)
+	revoked := newTestResponder(t, ca)
+	revoked.answer = func(req *ocsp.Request) []byte {
+		now := time.Now()
+		return ca.ocspResponse(req, ocsp.Response{
+			Status:           ocsp.Revoked,
+			RevokedAt:        now.Add(-time.Hour),
+			RevocationReason: ocsp.Superseded,
+			ThisUpdate:       now.Add(-time.Minute),
+			NextUpdate:       now.Add(time.Hour),
+		})
+	}
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	in, out := t.TempDir(), t.TempDir()
+	r := newTestRenewer(t, Config{InputPaths: []string{in}, OutputDir: out})
+	ctx := context.Background()
+
+	t.Run("renewed", func(t *testing.T) {
+		path, leaf := ca.writeLeaf(t, in, "good.crt", broken.URL, good.URL)
+		res, err := r.RenewPath(ctx, path)
+		if err != nil || res.Err != nil {
+			t.Fatalf("RenewPath: %v", err)
+		}
+		if res.Outcome != ResultRenewed || !res.Written || res.Path != path {
+			t.Errorf("outcome %q, written %v, path %q", res.Outcome, res.Written, res.Path)
+		}
+		if !res.Cert.Equal(leaf) || !res.Issuer.Equal(ca.cert) {
+			t.Error("wrong cert or issuer")
+		}
+		if want := []string{broken.URL, good.URL}; !reflect.DeepEqual(res.Tried, want) || res.Responder != good.URL {
+			t.Errorf("tried %q answered by %q, want %q and the last", res.Tried, res.Responder, want)
+		}
+		if res.Response == nil || res.Response.Status != ocsp.Good || res.Previous != nil {
+			t.Errorf("response %v, previous %v", res.Response, res.Previous)
+		}
+		if want := filepath.Join(out, "good.crt.ocsp"); res.StaplePath != want || !reflect.DeepEqual(res.StaplePaths, []string{want}) {
+			t.Errorf("staple paths %q, %q; want %q", res.StaplePath, res.StaplePaths, want)
+		}
+		if _, err := os.Stat(res.StaplePath); err != nil {
+			t.Error(err)
+		}
+		// Not in a persistent run, so per T1 of 0.5.
+		if want := validityPoint(res.Response, 0.5); !res.NextCheck.Equal(want) {
+			t.Errorf("next check %s, want %s", res.NextCheck, want)
+		}
+
+		// Again, with what we just wrote as the previous staple.
+		res, _ = r.RenewPath(ctx, path)
+		if res.Previous == nil || res.Previous.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+			t.Errorf("previous staple %v", res.Previous)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		path, leaf := ca.writeLeaf(t, in, "revoked.crt", revoked.URL)
+		res, err := r.RenewPath(ctx, path)
+		var re RevokedError
+		if !errors.As(err, &re) || re.Reason != ocsp.Superseded || !re.Cert.Equal(leaf) {
+			t.Fatalf("got error %v, want RevokedError", err)
+		}
+		if res.Outcome != ResultRevoked || res.Response == nil || res.Response.Status != ocsp.Revoked {
+			t.Errorf("outcome %q, response %v", res.Outcome, res.Response)
+		}
+		if !res.NextCheck.IsZero() {
+			t.Errorf("next check %s for a revoked cert", res.NextCheck)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		path, _ := ca.writeLeaf(t, in, "failed.crt", broken.URL)
+		before := time.Now()
+		res, err := r.RenewPath(ctx, path)
+		if err == nil || res.Err != err {
+			t.Fatalf("got error %v, result error %v", err, res.Err)
+		}
+		if res.Outcome != ResultFailed || res.Written || res.Response != nil || res.Responder != "" {
+			t.Errorf("got %+v", res)
+		}
+		if !reflect.DeepEqual(res.Tried, []string{broken.URL}) {
+			t.Errorf("tried %q", res.Tried)
+		}
+		// With no staple at all, we're in danger.
+		if want := before.Add(r.retryInDanger()); res.NextCheck.Before(want) || res.NextCheck.After(want.Add(time.Minute)) {
+			t.Errorf("next check %s, want about %s", res.NextCheck, want)
+		}
+	})
+
+	t.Run("unreadable", func(t *testing.T) {
+		res, err := r.RenewPath(ctx, filepath.Join(in, "missing.crt"))
+		if !os.IsNotExist(err) || res.Cert != nil || res.Outcome != ResultFailed {
+			t.Errorf("got %v, %+v", err, res)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		path, _ := ca.writeLeaf(t, in, "cancelled.crt", good.URL)
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if res, err := r.RenewPath(cctx, path); !errors.Is(err, context.Canceled) || res.Written {
+			t.Errorf("got %v, written %v", err, res.Written)
+		}
+	})
+}
+
+func TestNextCheckWithoutProducedAt(t *testing.T) {
+	r := newTestRenewer(t, Config{TimerT2: 0.9, RetryBackoffMin: time.Minute})
+	now := time.Now()
+	cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", policy: r.basePolicy,
+		oldStaple: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(time.Hour)}}
+
+	// Not clamped to a T2 measured from the zero time.
+	if got := cr.nextCheck(ErrHTTPFailure); got.Before(now.Add(time.Minute)) {
+		t.Errorf("next check %s after a failure, want a minute's backoff from %s", got, now)
+	}
+}
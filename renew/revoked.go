@@ -0,0 +1,140 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Values for Config.RevocationPolicy: what to do when the CA says a cert is
+// revoked.  Whichever it is, the revocation hooks are run and the cert is not
+// checked again, by timers or sweeps, forced or not, until replaced by a cert
+// with a different serial.  Only an explicit renewal of that one cert (`ctl
+// renew`, or RenewPath) asks the CA again.
+const (
+	RevocationKeep      = "keep"       // leave the existing staple alone; the default
+	RevocationDelete    = "delete"     // remove the staples, so nothing is served
+	RevocationWrite     = "write"      // install the revoked response, so clients see it
+	RevocationMoveAside = "move-aside" // rename the cert file with RevokedExtension
+)
+
+// RevokedExtension is appended to the filename of a cert moved aside.
+const RevokedExtension = ".revoked"
+
+// Values for OCSPRENEWER_OUTCOME, beyond HookOutcomeRenewed
+const (
+	HookOutcomeRevoked = "revoked"
+)
+
+func checkRevocationPolicy(p string) error {
+	switch p {
+	case RevocationKeep, RevocationDelete, RevocationWrite, RevocationMoveAside:
+		return nil
+	}
+	return fmt.Errorf("unknown revocation policy %q", p)
+}
+
+// handleRevoked applies the revocation policy, after the CA told us the cert
+// is revoked, and runs the revocation hooks.  It returns the RevokedError for
+// the caller to return.
+func (cr *CertRenewal) handleRevoked(staple *ocsp.Response, rawStaple []byte) error {
+	r := cr.Renewer
+	revErr := RevokedError{Cert: cr.cert, RevokedAt: staple.RevokedAt, Reason: staple.RevocationReason}
+
+	// A responder we shouldn't trust doesn't get to make us delete things.
+	if err := checkResponderAuthorized(staple.Certificate, cr.issuer, time.Now()); err != nil {
+		r.metrics.stapleRejected(ErrUnauthorizedSigner)
+		return RejectedStapleError{Cert: cr.cert, Reason: ErrUnauthorizedSigner, Detail: err.Error()}
+	}
+
+	policy := r.config.RevocationPolicy
+	cr.CertWarnf("REVOKED: serial %s revoked at %s (reason %d); policy %q",
+		cr.cert.SerialNumber.Text(16), staple.RevokedAt, staple.RevocationReason, policy)
+
+	var actionErr error
+	stapleChanged := false
+	if !r.permitFileUpdate && policy != RevocationKeep {
+		cr.CertLogf("file update inhibited, not applying revocation policy %q", policy)
+	} else {
+		switch policy {
+		case RevocationDelete:
+			for _, sp := range cr.staplePaths {
+				if err := os.Remove(sp); err != nil && !os.IsNotExist(err) {
+					cr.CertErrorf("FAIL removing staple %q: %s", sp, err)
+					actionErr = err
+				} else if err == nil {
+					cr.CertLogf("removed staple %q", sp)
+					stapleChanged = true
+				}
+			}
+		case RevocationWrite:
+			sd := &StapleData{Raw: rawStaple, Response: staple, Cert: cr.cert, SourceURL: cr.responderURL}
+			for i, out := range cr.policy.outputs {
+				if wrote, err := cr.writeStapleTo(out, cr.staplePaths[i], sd); err != nil {
+					cr.CertErrorf("FAIL writing revoked staple to %q: %s", cr.staplePaths[i], err)
+					actionErr = err
+				} else if wrote {
+					stapleChanged = true
+				}
+			}
+		case RevocationMoveAside:
+			aside := cr.certPath + RevokedExtension
+			if err := os.Rename(cr.certPath, aside); err != nil {
+				cr.CertErrorf("FAIL moving cert aside to %q: %s", aside, err)
+				actionErr = err
+			} else {
+				cr.CertLogf("moved cert aside to %q", aside)
+			}
+		}
+	}
+
+	ev := hookEvent{
+		certPath:   cr.certPath,
+		staplePath: cr.staplePath,
+		label:      cr.certLabel(),
+		outcome:    HookOutcomeRevoked,
+	}
+	if stapleChanged {
+		ev.hooks = cr.policy.hooks
+		r.hooks.queue(ev)
+	}
+	ev.hooks = r.config.RevocationHooks
+	r.hooks.runNow(ev,
+		"OCSPRENEWER_SERIAL="+cr.cert.SerialNumber.Text(16),
+		"OCSPRENEWER_REVOKED_AT="+staple.RevokedAt.UTC().Format(time.RFC3339),
+		"OCSPRENEWER_REVOCATION_REASON="+strconv.Itoa(staple.RevocationReason),
+		"OCSPRENEWER_REVOCATION_POLICY="+policy,
+	)
+
+	if actionErr != nil {
+		return fmt.Errorf("%w; applying revocation policy %q: %s", revErr, policy, actionErr)
+	}
+	return revErr
+}
+
+// revokedSkip says whether the cert is one we've already been told is
+// revoked, so shouldn't be checked again.
+func (r *Renewer) revokedSkip(p, serial string) bool {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	st, ok := r.certStatus[p]
+	return ok && st.Revoked && st.Serial == serial
+}
+
+// unschedule stops timer-based checks of the cert at path p.
+func (r *Renewer) unschedule(p string) {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	if _, ok := r.nextRenew[p]; !ok {
+		return
+	}
+	delete(r.nextRenew, p)
+	r.recomputeEarliestNextRenew()
+}
@@ -0,0 +1,181 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestHandleRevoked(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	revokedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	const oldStaple = "the previous staple"
+
+	for _, tc := range []struct {
+		policy      string
+		signer      *testCA
+		stapleAfter string // "" for none, "revoked" for the new response
+		certMoved   bool
+		wantErr     error
+	}{
+		{policy: RevocationKeep, signer: ca, stapleAfter: oldStaple},
+		{policy: RevocationDelete, signer: ca, stapleAfter: ""},
+		{policy: RevocationWrite, signer: ca, stapleAfter: "revoked"},
+		{policy: RevocationMoveAside, signer: ca, stapleAfter: oldStaple, certMoved: true},
+		{policy: RevocationDelete, signer: other, stapleAfter: oldStaple, wantErr: ErrUnauthorizedSigner},
+	} {
+		t.Run(tc.policy+" signed by "+tc.signer.cert.Subject.CommonName, func(t *testing.T) {
+			hookCommand := `printf '%s %s %s\n' "$OCSPRENEWER_OUTCOME" "$OCSPRENEWER_SERIAL" "$OCSPRENEWER_REVOCATION_POLICY" >> `
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			r := newTestRenewer(t, Config{
+				CertExtensions:   ".crt",
+				RevocationPolicy: tc.policy,
+				RevocationHooks:  []string{hookCommand + hookLog},
+			})
+			certPath, leaf := ca.writeLeaf(t, r.config.InputPaths[0], "site.crt")
+			cr := &CertRenewal{Renewer: r, certPath: certPath, policy: r.policyFor(certPath), cert: leaf, issuer: ca.cert}
+			if err := cr.findStaple(); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(cr.staplePath, []byte(oldStaple), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Parsing without the issuer checks only that the response is
+			// self-consistent; who signed it is for handleRevoked to check.
+			raw := tc.signer.ocspResponse(&ocsp.Request{SerialNumber: leaf.SerialNumber}, ocsp.Response{
+				Status:           ocsp.Revoked,
+				RevokedAt:        revokedAt,
+				RevocationReason: ocsp.KeyCompromise,
+				ThisUpdate:       time.Now().Add(-time.Minute),
+				NextUpdate:       time.Now().Add(time.Hour),
+			})
+			staple, err := ocsp.ParseResponse(raw, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.signer != ca {
+				staple.Certificate = tc.signer.cert
+			}
+
+			err = cr.handleRevoked(staple, raw)
+			var revErr RevokedError
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got %v, want %v", err, tc.wantErr)
+				}
+			case !errors.As(err, &revErr):
+				t.Fatalf("got %v, want a RevokedError", err)
+			case !revErr.RevokedAt.Equal(revokedAt) || revErr.Reason != ocsp.KeyCompromise:
+				t.Errorf("RevokedError %+v, want revoked at %s for key compromise", revErr, revokedAt)
+			}
+
+			got, err := os.ReadFile(cr.staplePath)
+			switch tc.stapleAfter {
+			case "":
+				if !os.IsNotExist(err) {
+					t.Errorf("staple still there: %v", err)
+				}
+			case "revoked":
+				if !bytes.Equal(got, raw) {
+					t.Errorf("staple holds %q, want the revoked response", got)
+				}
+			default:
+				if string(got) != tc.stapleAfter {
+					t.Errorf("staple holds %q (%v), want %q", got, err, tc.stapleAfter)
+				}
+			}
+			_, certErr := os.Stat(certPath)
+			_, asideErr := os.Stat(certPath + RevokedExtension)
+			if tc.certMoved != (certErr != nil) || tc.certMoved != (asideErr == nil) {
+				t.Errorf("cert moved aside %v, want %v", certErr != nil, tc.certMoved)
+			}
+
+			hookRan, _ := os.ReadFile(hookLog)
+			want := ""
+			if tc.wantErr == nil {
+				want = "revoked " + leaf.SerialNumber.Text(16) + " " + tc.policy + "\n"
+			}
+			if string(hookRan) != want {
+				t.Errorf("revocation hook logged %q, want %q", hookRan, want)
+			}
+		})
+	}
+}
+
+func TestRevokedSkip(t *testing.T) {
+	r := newTestRenewer(t, Config{})
+	r.certStatus["/etc/ssl/revoked.crt"] = &CertStatus{Serial: "1a", Revoked: true}
+	r.certStatus["/etc/ssl/fine.crt"] = &CertStatus{Serial: "1b"}
+
+	for _, tc := range []struct {
+		path, serial string
+		want         bool
+	}{
+		{"/etc/ssl/revoked.crt", "1a", true},
+		{"/etc/ssl/revoked.crt", "2a", false}, // replaced
+		{"/etc/ssl/fine.crt", "1b", false},
+		{"/etc/ssl/new.crt", "1c", false},
+	} {
+		if got := r.revokedSkip(tc.path, tc.serial); got != tc.want {
+			t.Errorf("revokedSkip(%q, %q) = %v, want %v", tc.path, tc.serial, got, tc.want)
+		}
+	}
+}
+
+func TestRevokedNotCheckedAgain(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	responder.answer = func(req *ocsp.Request) []byte {
+		return ca.ocspResponse(req, ocsp.Response{
+			Status:     ocsp.Revoked,
+			RevokedAt:  time.Now().Add(-time.Hour),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+		})
+	}
+	dir := t.TempDir()
+	certPath, _ := ca.writeLeaf(t, dir, "site.crt", responder.URL)
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{dir}})
+	r.needTimers = true
+
+	for i := 0; i < 2; i++ {
+		_ = r.OneShot()
+		if requests, _ := responder.counts(); requests != 1 {
+			t.Fatalf("sweep %d: %d requests, want just the first", i+1, requests)
+		}
+		if st := r.certStatus[certPath]; st == nil || !st.Revoked || st.LastResult != ResultRevoked {
+			t.Errorf("sweep %d: status %+v, want revoked", i+1, st)
+		}
+		if at, ok := r.nextRenew[certPath]; ok {
+			t.Errorf("sweep %d: revoked cert scheduled for %s", i+1, at)
+		}
+	}
+
+	// A forced full sweep, as for SIGUSR2, doesn't check it either.
+	_ = r.SetImmediate(true)
+	_ = r.OneShot()
+	if requests, _ := responder.counts(); requests != 1 {
+		t.Errorf("forced full sweep: %d requests, want no more", requests)
+	}
+
+	// Asking for just this cert does.
+	if _, err := r.RenewPath(context.Background(), certPath); !errors.As(err, &RevokedError{}) {
+		t.Errorf("RenewPath: got %v, want still revoked", err)
+	}
+	if requests, _ := responder.counts(); requests != 2 {
+		t.Errorf("RenewPath: %d requests, want 2", requests)
+	}
+}
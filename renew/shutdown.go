@@ -0,0 +1,154 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long in-flight work gets to finish once
+// shutdown is requested, used when Config.ShutdownTimeout is zero.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// ErrShuttingDown is returned for certs which we declined to start work on
+// because we're shutting down.  It's not counted as a failure.
+var ErrShuttingDown = errors.New("shutting down")
+
+// Shutdown asks a persistent run (see Start) to finish up and return: no new
+// work is started, work in progress gets Config.ShutdownTimeout to finish
+// before its network requests are abandoned, and then Start returns true.
+// Shutdown does not wait for that; it's safe to call more than once.
+func (r *Renewer) Shutdown() {
+	r.shutdownOnce.Do(func() {
+		r.Logf("shutdown requested, allowing %s for work in progress", r.shutdownTimeout())
+		r.stopCancel()
+		time.AfterFunc(r.shutdownTimeout(), r.abandonCancel)
+	})
+}
+
+func (r *Renewer) shutdownTimeout() time.Duration {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
+	if r.config.ShutdownTimeout > 0 {
+		return r.config.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
+}
+
+// stopping says whether Shutdown has been called
+func (r *Renewer) stopping() bool {
+	return r.stopCtx.Err() != nil
+}
+
+// sleepUnlessStopping sleeps for dur, returning early (and false) if Shutdown
+// is called.
+func (r *Renewer) sleepUnlessStopping(dur time.Duration) bool {
+	sleeper := time.NewTimer(dur)
+	defer sleeper.Stop()
+	select {
+	case <-sleeper.C:
+		return true
+	case <-r.stopCtx.Done():
+		return false
+	}
+}
+
+// finishShutdown is called by Start, once the persist loop has seen the
+// request to stop and any sweep in progress has finished.
+func (r *Renewer) finishShutdown() {
+	r.stopWatching()
+	if r.controlListener != nil {
+		_ = r.controlListener.Close()
+		// a renew requested over the socket may still be in progress
+		r.controlConns.Wait()
+	}
+	if r.httpServer != nil {
+		ctx, cancel := context.WithTimeout(r.abandonCtx, 5*time.Second)
+		if err := r.httpServer.Shutdown(ctx); err != nil {
+			r.Warnf("HTTP status service shutdown: %s", err)
+		}
+		cancel()
+	}
+
+	r.FlushHooks()
+	r.FlushNotifications()
+	r.removeTempStaples()
+
+	var renewed, failed, revoked, danger int
+	statuses := r.CertStatuses()
+	for i := range statuses {
+		switch statuses[i].LastResult {
+		case ResultRenewed:
+			renewed++
+		case ResultFailed:
+			failed++
+		case ResultRevoked:
+			revoked++
+		}
+		if statuses[i].InDanger {
+			danger++
+		}
+	}
+	r.Logf("shutdown after %s: %d certs tracked, last results %d renewed, %d failed, %d revoked; %d in danger",
+		time.Since(r.started).Round(time.Second), len(statuses), renewed, failed, revoked, danger)
+}
+
+// removeTempStaples removes any newstaple* files, as made by writeStapleTo,
+// from the places we write staples.  They're left behind if the process dies
+// mid-write.
+func (r *Renewer) removeTempStaples() {
+	if !r.permitFileUpdate {
+		return
+	}
+	dirs := make(map[string]bool)
+	for _, out := range r.basePolicy.outputs {
+		if out.Layout != LayoutBeside {
+			dirs[out.Dir] = true
+		}
+	}
+	for _, b := range r.policies {
+		for _, out := range b.outputs {
+			if out.Layout != LayoutBeside {
+				dirs[out.Dir] = true
+			}
+		}
+	}
+	// With beside and mirror layouts, staples are in per-cert directories,
+	// for every output.  We also know where the primary ones went, even if
+	// a reload has since changed the outputs.
+	for _, p := range r.trackedPaths() {
+		for _, out := range r.policyFor(p).outputs {
+			if out.Layout == LayoutFlat {
+				continue
+			}
+			if sp, err := out.pathFor(p, ""); err == nil {
+				dirs[filepath.Dir(sp)] = true
+			}
+		}
+	}
+	for _, st := range r.CertStatuses() {
+		if st.StaplePath != "" {
+			dirs[filepath.Dir(st.StaplePath)] = true
+		}
+	}
+
+	for d := range dirs {
+		leftovers, err := filepath.Glob(filepath.Join(d, tempStaplePattern+"*"))
+		if err != nil {
+			continue
+		}
+		for _, fn := range leftovers {
+			if err := os.Remove(fn); err != nil {
+				r.Warnf("unable to remove temporary staple %q: %s", fn, err)
+			} else {
+				r.Logf("removed temporary staple %q", fn)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownMidSweep(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	slow, other := newTestResponder(t, ca), newTestResponder(t, ca)
+	slow.delay = time.Second
+	in, out := t.TempDir(), t.TempDir()
+	ca.writeLeaf(t, in, "a.crt", slow.URL)
+	ca.writeLeaf(t, in, "b.crt", other.URL)
+	// As left by an earlier run which died mid-write.
+	leftover := filepath.Join(out, tempStaplePattern+"12345")
+	if err := os.WriteFile(leftover, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRenewer(t, Config{
+		Directories:     true,
+		InputPaths:      []string{in},
+		OutputDir:       out,
+		ShutdownTimeout: 100 * time.Millisecond,
+	})
+	done := make(chan bool)
+	go func() { done <- r.Start() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, maxInFlight := slow.counts(); maxInFlight > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sweep never asked the responder")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// b.crt may or may not have been done first.
+	otherBefore, _ := other.counts()
+	r.Shutdown()
+	r.Shutdown() // harmless
+	if r.stopCtx.Err() == nil {
+		t.Error("stopCtx not cancelled by Shutdown")
+	}
+	if r.abandonCtx.Err() != nil {
+		t.Error("abandonCtx cancelled without giving work in progress a chance")
+	}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Start returned false after Shutdown")
+		}
+	case <-time.After(slow.delay / 2):
+		t.Fatal("Start didn't return once the shutdown timeout abandoned the request")
+	}
+	if r.abandonCtx.Err() == nil {
+		t.Error("abandonCtx not cancelled after the shutdown timeout")
+	}
+	if requests, _ := other.counts(); requests != otherBefore {
+		t.Errorf("%d requests started after Shutdown", requests-otherBefore)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary staple not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "a.ocsp")); !os.IsNotExist(err) {
+		t.Errorf("abandoned fetch still wrote a staple: %v", err)
+	}
+}
+
+func TestStartContextCancelled(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	in := t.TempDir()
+	ca.writeLeaf(t, in, "leaf.crt", newTestResponder(t, ca).URL)
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{in}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- r.StartContext(ctx) }()
+	// Long enough to have done the first sweep and gone to sleep until T1.
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("StartContext returned false when its context was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartContext still sleeping after its context was cancelled")
+	}
+}
+
+func TestRemoveTempStaples(t *testing.T) {
+	top := t.TempDir()
+	mkdir := func(parts ...string) string {
+		d := filepath.Join(append([]string{top}, parts...)...)
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	web, mail := mkdir("in", "web"), mkdir("in", "mail")
+	flat, mirror := mkdir("flat"), mkdir("mirror")
+	mirroredWeb := mkdir("mirror", "web")
+
+	r := newTestRenewer(t, Config{
+		Directories: true,
+		InputPaths:  []string{web, mail},
+		Outputs: []OutputSpec{
+			{Dir: flat},
+			{Layout: LayoutBeside},
+			{Dir: mirror, Layout: LayoutMirror},
+		},
+	})
+	r.needTimers = true
+	r.RegisterFutureCheck(filepath.Join(web, "site.crt"), time.Now().Add(time.Hour))
+
+	// Only the first output is the primary one, but all of them get swept.
+	var leftovers []string
+	for _, d := range []string{flat, web, mirroredWeb} {
+		leftovers = append(leftovers, filepath.Join(d, tempStaplePattern+"1"))
+	}
+	keep := filepath.Join(web, "site.ocsp")
+	touch(t, append(leftovers, keep)...)
+
+	r.removeTempStaples()
+	for _, fn := range leftovers {
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("temporary staple %q not removed", fn)
+		}
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("staple removed: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is bumped if the state file changes incompatibly; a state file
+// of another version is ignored.
+const stateVersion = 1
+
+// savedState is the contents of Config.StateFile: what we know about each
+// cert, including when it's next to be checked, so that a restart picks up
+// where we left off instead of rebuilding all timers from scratch.
+type savedState struct {
+	Version int          `json:"version"`
+	Saved   time.Time    `json:"saved"`
+	Certs   []CertStatus `json:"certs"`
+}
+
+// loadState restores from the state file, if there is one.  Certs whose file
+// has gone away are dropped.  Scheduled checks still in the future are kept
+// for the first sweep to honour; see resumeTimeFor.
+func (r *Renewer) loadState() error {
+	if r.config.StateFile == "" {
+		return nil
+	}
+	contents, err := os.ReadFile(r.config.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			r.Logf("no state file at %q, starting afresh", r.config.StateFile)
+			return nil
+		}
+		return err
+	}
+
+	var state savedState
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return fmt.Errorf("state file %q: %w", r.config.StateFile, err)
+	}
+	if state.Version != stateVersion {
+		r.Logf("ignoring state file %q: version %d, we use %d", r.config.StateFile, state.Version, stateVersion)
+		return nil
+	}
+
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	r.resumeAt = make(map[string]time.Time)
+	for i := range state.Certs {
+		st := state.Certs[i]
+		if _, err := os.Stat(st.Path); err != nil {
+			continue
+		}
+		if !st.NextCheck.IsZero() {
+			r.resumeAt[st.Path] = st.NextCheck
+		}
+		st.NextCheck = time.Time{} // derived from nextRenew
+		r.certStatus[st.Path] = &st
+	}
+	r.Logf("restored state of %d certs from %q, saved %s", len(r.certStatus), r.config.StateFile, state.Saved)
+	return nil
+}
+
+// resumeTimeFor returns the check time for p saved in the state file, if any
+// and not yet passed, once only.  The first sweep after a restart uses this
+// to not check certs before they were due, eg while backing off.
+func (r *Renewer) resumeTimeFor(p string) (time.Time, bool) {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	t, ok := r.resumeAt[p]
+	if !ok {
+		return time.Time{}, false
+	}
+	delete(r.resumeAt, p)
+	if t.Before(time.Now()) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// saveState writes the state file, if configured and something has changed.
+// It's written to a temporary file and renamed into place, so a crash
+// mid-write doesn't lose the previous state.
+func (r *Renewer) saveState() {
+	if r.config.StateFile == "" || !r.permitFileUpdate {
+		return
+	}
+	statuses := r.CertStatuses()
+	certsJSON, err := json.Marshal(statuses)
+	if err != nil {
+		r.Errorf("FAIL encoding state: %s", err)
+		return
+	}
+	if bytes.Equal(certsJSON, r.lastSavedState) {
+		return
+	}
+
+	contents, err := json.MarshalIndent(savedState{
+		Version: stateVersion,
+		Saved:   time.Now(),
+		Certs:   statuses,
+	}, "", "  ")
+	if err != nil {
+		r.Errorf("FAIL encoding state: %s", err)
+		return
+	}
+	if err := writeFileAtomically(r.config.StateFile, append(contents, '\n'), 0o600); err != nil {
+		r.Errorf("FAIL saving state to %q: %s", r.config.StateFile, err)
+		return
+	}
+	r.lastSavedState = certsJSON
+	r.LogAtf(1, "saved state of %d certs to %q", len(statuses), r.config.StateFile)
+}
+
+func writeFileAtomically(path string, contents []byte, mode os.FileMode) error {
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".new")
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(contents); err != nil {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	if err := os.Chmod(fh.Name(), mode); err != nil {
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	if err := os.Rename(fh.Name(), path); err != nil {
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	return nil
+}
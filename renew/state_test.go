@@ -0,0 +1,190 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+	kept, backingOff, gone := filepath.Join(dir, "kept.crt"), filepath.Join(dir, "backing-off.crt"), filepath.Join(dir, "gone.crt")
+	touch(t, kept, backingOff)
+
+	produced := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	statuses := map[string]*CertStatus{
+		kept: {
+			Path:        kept,
+			Label:       "kept.example",
+			Serial:      "1a2b",
+			Issuer:      "Test CA",
+			OCSPURL:     "http://ocsp.example/",
+			Responder:   "http://ocsp.example/",
+			StaplePath:  filepath.Join(dir, "kept.ocsp"),
+			ThisUpdate:  produced,
+			NextUpdate:  produced.Add(7 * 24 * time.Hour),
+			LastAttempt: produced.Add(time.Minute),
+			LastResult:  ResultRenewed,
+		},
+		backingOff: {
+			Path:                backingOff,
+			Label:               "backing-off.example",
+			LastAttempt:         produced,
+			LastResult:          ResultFailed,
+			LastError:           "HTTP failure retrieving OCSP staple",
+			ConsecutiveFailures: 3,
+		},
+		gone: {Path: gone, Label: "gone.example"},
+	}
+	future := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	r := newTestRenewer(t, Config{StateFile: stateFile})
+	for p, st := range statuses {
+		st := *st
+		r.certStatus[p] = &st
+	}
+	r.nextRenew[kept] = time.Now().Add(-time.Minute)
+	r.nextRenew[backingOff] = future
+	r.saveState()
+
+	fi, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatalf("state file not saved: %s", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("state file mode %o, want 600", mode)
+	}
+
+	restored := newTestRenewer(t, Config{StateFile: stateFile})
+	if err := restored.loadState(); err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	if _, ok := restored.certStatus[gone]; ok {
+		t.Errorf("status restored for %q, whose cert no longer exists", gone)
+	}
+	for _, p := range []string{kept, backingOff} {
+		if got := restored.certStatus[p]; !reflect.DeepEqual(got, statuses[p]) {
+			t.Errorf("restored status for %q:\n got %+v\nwant %+v", p, got, statuses[p])
+		}
+	}
+
+	// A check time already passed is no reason to wait; one in the future is,
+	// but only the once.
+	if at, ok := restored.resumeTimeFor(kept); ok {
+		t.Errorf("resume time %s for %q, whose check was due", at, kept)
+	}
+	if at, ok := restored.resumeTimeFor(backingOff); !ok || !at.Equal(future) {
+		t.Errorf("resume time for %q: %s, %v; want %s", backingOff, at, ok, future)
+	}
+	if _, ok := restored.resumeTimeFor(backingOff); ok {
+		t.Errorf("resume time for %q given twice", backingOff)
+	}
+}
+
+func TestSaveStateOnlyOnChange(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	r := newTestRenewer(t, Config{StateFile: stateFile})
+	r.certStatus["/etc/ssl/site.crt"] = &CertStatus{Path: "/etc/ssl/site.crt", LastResult: ResultRenewed}
+	r.saveState()
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(stateFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	r.saveState()
+	if fi, err := os.Stat(stateFile); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("state file rewritten with nothing changed: %v", err)
+	}
+
+	r.certStatus["/etc/ssl/site.crt"].LastResult = ResultFailed
+	r.saveState()
+	if fi, err := os.Stat(stateFile); err != nil || fi.ModTime().Equal(old) {
+		t.Errorf("state file not rewritten after a change: %v", err)
+	}
+
+	r.SetNotReally(true)
+	if err := os.Remove(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	r.certStatus["/etc/ssl/site.crt"].LastResult = ResultRenewed
+	r.saveState()
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file saved with file updates inhibited: %v", err)
+	}
+}
+
+func TestLoadStateIgnores(t *testing.T) {
+	site := filepath.Join(t.TempDir(), "site.crt")
+	touch(t, site)
+	for _, tc := range []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{"other version", `{"version": 99, "certs": [{"path": "` + site + `"}]}`, false},
+		{"corrupt", `{"version": 1, "certs": [`, true},
+	} {
+		stateFile := filepath.Join(t.TempDir(), "state.json")
+		if err := os.WriteFile(stateFile, []byte(tc.contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		r := newTestRenewer(t, Config{StateFile: stateFile})
+		if err := r.loadState(); tc.wantErr != (err != nil) {
+			t.Errorf("%s: loadState gave %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if len(r.certStatus) != 0 {
+			t.Errorf("%s: restored %d statuses, want none", tc.name, len(r.certStatus))
+		}
+	}
+
+	r := newTestRenewer(t, Config{StateFile: filepath.Join(t.TempDir(), "missing.json")})
+	if err := r.loadState(); err != nil {
+		t.Errorf("loadState with no state file yet: %s", err)
+	}
+}
+
+// The first sweep of a restarted daemon waits on the saved schedule, unless
+// told to renew everything now.
+func TestFirstSweepResumes(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := newTestResponder(t, ca)
+	in := t.TempDir()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	path, _ := ca.writeLeaf(t, in, "site.crt", responder.URL)
+	c := Config{Directories: true, InputPaths: []string{in}, StateFile: stateFile}
+
+	r := newTestRenewer(t, c)
+	if err := r.OneShot(); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	r.nextRenew[path] = future
+	r.saveState()
+	before, _ := responder.counts()
+
+	for _, immediate := range []bool{false, true} {
+		restarted := newTestRenewer(t, c)
+		restarted.needTimers = true
+		_ = restarted.SetImmediate(immediate)
+		if err := restarted.loadState(); err != nil {
+			t.Fatal(err)
+		}
+		if err := restarted.OneShot(); err != nil {
+			t.Fatal(err)
+		}
+		requests, _ := responder.counts()
+		switch {
+		case !immediate && (requests != before || !restarted.nextRenew[path].Equal(future)):
+			t.Errorf("resumed with %d requests, next check %s; want none, and %s", requests-before, restarted.nextRenew[path], future)
+		case immediate && requests != before+1:
+			t.Errorf("immediate sweep made %d requests, want 1", requests-before)
+		}
+	}
+}
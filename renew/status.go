@@ -0,0 +1,171 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Values for CertStatus.LastResult
+const (
+	ResultRenewed = "renewed" // fetched and (unless inhibited) wrote a staple
+	ResultSkipped = "skipped" // not yet time to renew
+	ResultFailed  = "failed"  // see LastError
+	ResultRevoked = "revoked" // the CA says so; not checked again until the serial changes
+)
+
+// CertStatus is a snapshot of what we know about one tracked cert, as
+// reported by the HTTP status service.
+type CertStatus struct {
+	Path        string    `json:"path"`
+	Label       string    `json:"label"`
+	Serial      string    `json:"serial"`
+	Issuer      string    `json:"issuer"`
+	OCSPURL     string    `json:"ocsp_url"`
+	Responder   string    `json:"responder,omitempty"` // which OCSP URL last gave a usable answer
+	StaplePath  string    `json:"staple_path"`
+	ThisUpdate  time.Time `json:"this_update"`
+	NextUpdate  time.Time `json:"next_update"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastResult  string    `json:"last_result"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextCheck   time.Time `json:"next_check"`
+
+	ConsecutiveFailures int  `json:"consecutive_failures"`
+	InDanger            bool `json:"in_danger"` // past T2, or failing with no usable staple
+
+	Revoked   bool      `json:"revoked"` // for Serial
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// recordStatus updates the tracked status for the cert at the end of handling
+// it; err is the outcome of that handling.
+func (cr *CertRenewal) recordStatus(err error) {
+	if err == ErrNoOCSPFlagfile || err == ErrNoOCSPInCert {
+		return
+	}
+
+	r := cr.Renewer
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+
+	st, ok := r.certStatus[cr.certPath]
+	if !ok {
+		st = &CertStatus{Path: cr.certPath}
+		r.certStatus[cr.certPath] = st
+	}
+
+	if cr.cert != nil {
+		st.Label = cr.certLabel()
+		if serial := cr.cert.SerialNumber.Text(16); serial != st.Serial {
+			st.Serial = serial
+			st.Revoked = false
+			st.RevokedAt = time.Time{}
+		}
+		if servers := cr.ocspServers(); len(servers) > 0 {
+			st.OCSPURL = servers[0]
+		}
+	}
+	if cr.issuer != nil {
+		st.Issuer = certLabel(cr.issuer)
+	} else if cr.cert != nil {
+		// we only go looking for the issuer cert when renewing
+		st.Issuer = cr.cert.Issuer.String()
+	}
+	if cr.staplePath != "" {
+		st.StaplePath = cr.staplePath
+	}
+
+	var revoked RevokedError
+	isRevoked := errors.As(err, &revoked)
+	// Only an answer we could use makes a responder the one to ask first
+	// next time.
+	if cr.responderURL != "" && (err == nil || isRevoked) {
+		st.Responder = cr.responderURL
+	}
+
+	staple := cr.newStaple
+	if staple == nil {
+		staple = cr.oldStaple
+	}
+	if staple != nil {
+		st.ThisUpdate = staple.ThisUpdate
+		st.NextUpdate = staple.NextUpdate
+		st.InDanger = r.inDanger(staple, time.Now())
+	} else {
+		st.InDanger = err != nil
+	}
+
+	switch {
+	case isRevoked:
+		st.LastAttempt = time.Now()
+		st.LastResult = ResultRevoked
+		st.LastError = err.Error()
+		st.Revoked = true
+		st.RevokedAt = revoked.RevokedAt
+		st.InDanger = false
+	case err != nil:
+		st.LastAttempt = time.Now()
+		st.LastResult = ResultFailed
+		st.LastError = err.Error()
+		st.ConsecutiveFailures++
+	case cr.attempted:
+		st.LastAttempt = time.Now()
+		st.LastResult = ResultRenewed
+		st.LastError = ""
+		st.ConsecutiveFailures = 0
+	case st.LastResult == "":
+		st.LastResult = ResultSkipped
+	}
+}
+
+// CertStatuses returns a snapshot of the status of all tracked certs, sorted
+// by path.
+func (r *Renewer) CertStatuses() []CertStatus {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+
+	list := make([]CertStatus, 0, len(r.certStatus))
+	for p, st := range r.certStatus {
+		entry := *st
+		entry.NextCheck = r.nextRenew[p]
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// certStatusOf returns the status of the cert at path p, as tracked.
+func (r *Renewer) certStatusOf(p string) (CertStatus, bool) {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	st, ok := r.certStatus[p]
+	if !ok {
+		return CertStatus{}, false
+	}
+	entry := *st
+	entry.NextCheck = r.nextRenew[p]
+	return entry, true
+}
+
+func (r *Renewer) consecutiveFailures(p string) int {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	if st, ok := r.certStatus[p]; ok {
+		return st.ConsecutiveFailures
+	}
+	return 0
+}
+
+func (r *Renewer) lastGoodResponder(p string) string {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	if st, ok := r.certStatus[p]; ok {
+		return st.Responder
+	}
+	return ""
+}
@@ -5,6 +5,7 @@
 package renew // import "go.pennock.tech/ocsprenewer/renew"
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const NoOCSPExtension = ".noocsp"
@@ -34,20 +36,26 @@ var (
 // OneShot does a sweep of all candidates and renews if appropriate.
 // Appropriateness is a combination of "immediate" and timers.
 func (r *Renewer) OneShot() error {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
 	return r.sweepOverPaths(r.config.InputPaths, r.oneInputPath)
 }
 
 // This is used both by OneShot and when triggered for sweeping over collected
 // paths for timer-based checks.
 func (r *Renewer) sweepOverPaths(consider []string, probeFunc func(string) error) error {
-	failed := 0
-	for i := range consider {
-		err := probeFunc(consider[i])
+	failed := r.forEachConcurrently(consider, func(p string) bool {
+		err := probeFunc(p)
+		if err == ErrShuttingDown {
+			return true
+		}
 		if err != nil {
-			r.Logf("failure: %s", err)
-			failed += 1
+			r.Warnf("failure: %s", err)
+			return false
 		}
-	}
+		return true
+	})
+	r.metrics.sweepDone(failed > 0)
 	if failed > 0 {
 		return fmt.Errorf("encountered %d failures", failed)
 	}
@@ -88,7 +96,7 @@ func (r *Renewer) oneInputDirectory(dirname string) error {
 		return ErrNoCertsFound
 	}
 
-	tried := 0
+	var tryList []string
 CandidateLoop:
 	for _, c := range candidates {
 		_, err := os.Stat(c + NoOCSPExtension)
@@ -102,11 +110,10 @@ CandidateLoop:
 				continue CandidateLoop
 			}
 		}
-		tried += 1
-		if !r.oneFilenameSuccess(c) {
-			errCount += 1
-		}
+		tryList = append(tryList, c)
 	}
+	tried := len(tryList)
+	errCount = r.forEachConcurrently(tryList, r.oneFilenameSuccess)
 
 	if errCount > 0 {
 		return fmt.Errorf("saw %d errors in dir %q", errCount, dirname)
@@ -121,42 +128,73 @@ CandidateLoop:
 // allowed to suppress errors on that basis
 func (r *Renewer) oneFilenameSuccess(p string) bool {
 	err := r.oneFilename(p)
-	if err == nil {
+	if err == nil || err == ErrShuttingDown {
 		return true
 	}
-	if r.config.AllowNonOCSPInDir && err == ErrNoOCSPInCert {
+	if err == ErrNoOCSPInCert && r.policyFor(p).allowNonOCSPInDir {
 		r.LogAtf(1, "skipped %q because of acceptable lack of OCSP information", p)
 		return true
 	}
-	r.Logf("failed on %q: %s", p, err)
+	r.Warnf("failed on %q: %s", p, err)
 	return false
 }
 
 func (r *Renewer) oneFilename(p string) error {
-	var (
-		fi  os.FileInfo
-		err error
-	)
+	return r.handleCert(p, r.config.Immediate)
+}
+
+// handleCert looks at one cert, renewing it if immediate or if timers say so.
+// A cert we know to be revoked is skipped either way.
+func (r *Renewer) handleCert(p string, immediate bool) error {
+	_, err := r.handleCertContext(r.abandonCtx, p, immediate, false)
+	return err
+}
+
+// handleCertContext is handleCert with network requests made under ctx.  It
+// also returns the CertRenewal, if we got as far as starting one, for the
+// caller to report on.  With recheckRevoked, for a renewal of just this cert
+// asked for explicitly, a cert known to be revoked is checked again.
+func (r *Renewer) handleCertContext(ctx context.Context, p string, immediate, recheckRevoked bool) (cr *CertRenewal, err error) {
+	var fi os.FileInfo
+
+	// A reload can replace workSlots; we must release to the one we took from.
+	slots := r.workSlots
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-slots }()
+
+	// Work already started is allowed to finish, but we start no more.
+	if r.stopping() {
+		return nil, ErrShuttingDown
+	}
 
 	// If foo.noocsp exists then we ignore foo
 	_, err = os.Stat(p + NoOCSPExtension)
 	if err == nil {
-		return ErrNoOCSPFlagfile
+		return nil, ErrNoOCSPFlagfile
 	}
 
-	cr := CertRenewal{Renewer: r, certPath: p, ActionID: r.nextActionID()}
+	cr = &CertRenewal{Renewer: r, ActionID: r.nextActionID(), ctx: ctx, certPath: p, policy: r.policyFor(p)}
+	defer func() {
+		cr.recordStatus(err)
+		cr.logOutcome(err)
+		cr.notifyOutcome(err)
+	}()
 
 	fi, err = os.Stat(cr.certPath)
 	if err != nil {
-		return err
+		return cr, err
 	}
 	if fi.Size() > MaxCertFileSize {
-		return ErrCertFileTooLarge
+		return cr, ErrCertFileTooLarge
 	}
 
 	data, err := os.ReadFile(cr.certPath)
 	if err != nil {
-		return err
+		return cr, err
 	}
 
 	// We currently _only_ handle PEM input, and we only look at the first cert
@@ -164,34 +202,70 @@ func (r *Renewer) oneFilename(p string) error {
 
 	block, rawRestOfChain := pem.Decode(data)
 	if block == nil || block.Type != "CERTIFICATE" {
-		return ErrNotCertificate
+		return cr, ErrNotCertificate
 	}
 
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return err
+		return cr, err
 	}
-	if len(cert.OCSPServer) < 1 {
-		return ErrNoOCSPInCert
-	}
-
 	cr.cert = cert
+	if len(cr.ocspServers()) < 1 {
+		return cr, ErrNoOCSPInCert
+	}
 
-	for i := range cert.OCSPServer {
-		cr.CertLogf("path %q OCSP server %q", p, cert.OCSPServer[i])
+	for _, server := range cr.ocspServers() {
+		cr.CertLogf("OCSP server %q", server)
 	}
 
 	if err := cr.findStaple(); err != nil {
-		return err
+		return cr, err
 	}
 
-	if r.config.Immediate {
-		return cr.renewOneCertNow(rawRestOfChain)
+	// Otherwise every forced sweep would re-run the revocation policy and
+	// hooks, and notify again.
+	if !recheckRevoked && r.revokedSkip(p, cert.SerialNumber.Text(16)) {
+		cr.CertLogAtf(1, "skipping for known to be revoked")
+		r.unschedule(p)
+		return cr, nil
+	}
+	if immediate {
+		return cr, cr.renewOneCertNow(rawRestOfChain)
+	}
+	if t, ok := r.resumeTimeFor(p); ok {
+		cr.CertLogf("not due until %s, per saved state", t)
+		r.RegisterFutureCheck(p, t)
+		return cr, nil
 	}
 	if cr.timerMatch() {
-		return cr.renewOneCertNow(rawRestOfChain)
+		return cr, cr.renewOneCertNow(rawRestOfChain)
 	}
 
-	cr.CertLogAtf(1, "path %q skipping for not within OCSP timer", cr.certPath)
-	return nil
+	cr.CertLogAtf(1, "skipping for not within OCSP timer")
+	return cr, nil
+}
+
+// forEachConcurrently calls fn on each item in parallel, returning how many
+// calls reported failure.  This does not itself limit concurrency: that's done
+// per cert in oneFilename and per responder in the fetch, so that calls can be
+// nested (input directories, then the certs within them) without deadlock.
+func (r *Renewer) forEachConcurrently(items []string, fn func(string) bool) int {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	for i := range items {
+		wg.Add(1)
+		go func(item string) {
+			defer wg.Done()
+			if !fn(item) {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(items[i])
+	}
+	wg.Wait()
+	return failed
 }
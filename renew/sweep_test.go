@@ -0,0 +1,97 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimits(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+
+	for _, tc := range []struct {
+		name         string
+		concurrency  int
+		perResponder int
+		responders   int
+		wantMax      int // per responder
+	}{
+		{"global limit", 2, 8, 1, 2},
+		{"per-responder limit", 8, 3, 1, 3},
+		{"per-responder limit is per host", 8, 1, 2, 1},
+		{"one at a time", 1, 1, 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const certsEach = 6
+			dir := t.TempDir()
+			responders := make([]*testResponder, tc.responders)
+			for i := range responders {
+				responders[i] = newTestResponder(t, ca)
+				responders[i].delay = 50 * time.Millisecond
+				for j := 0; j < certsEach; j++ {
+					ca.writeLeaf(t, dir, fmt.Sprintf("r%d-%d.crt", i, j), responders[i].URL)
+				}
+			}
+			out := t.TempDir()
+			r := newTestRenewer(t, Config{
+				Directories:             true,
+				InputPaths:              []string{dir},
+				OutputDir:               out,
+				Concurrency:             tc.concurrency,
+				PerResponderConcurrency: tc.perResponder,
+			})
+
+			if err := r.OneShot(); err != nil {
+				t.Fatalf("OneShot: %s", err)
+			}
+			for i, tr := range responders {
+				requests, maxInFlight := tr.counts()
+				if requests != certsEach {
+					t.Errorf("responder %d: %d requests, want %d", i, requests, certsEach)
+				}
+				if maxInFlight != tc.wantMax {
+					t.Errorf("responder %d: up to %d requests at once, want %d", i, maxInFlight, tc.wantMax)
+				}
+			}
+			if staples, err := os.ReadDir(out); err != nil || len(staples) != certsEach*tc.responders {
+				t.Errorf("wrote %d staples (%v), want %d", len(staples), err, certsEach*tc.responders)
+			}
+		})
+	}
+}
+
+func TestForceCheckSoonCoalesces(t *testing.T) {
+	r := newTestRenewer(t, Config{})
+
+	// Nothing is consuming requests, as when the persist loop is busy with
+	// a long sweep; the control socket and signal handler mustn't hang.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			r.ForceCheckSoon(i == 3)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForceCheckSoon blocked")
+	}
+
+	at, full := r.forcedSweepCheck()
+	if at.IsZero() || !full {
+		t.Errorf("forced sweep at %s, full %v; want one pending, full", at, full)
+	}
+	if len(r.wakeup) != 1 {
+		t.Errorf("%d wakeups pending, want 1", len(r.wakeup))
+	}
+	r.forcedSweepResetFor(at)
+	if at, full = r.forcedSweepCheck(); !at.IsZero() || full {
+		t.Errorf("after reset, forced sweep at %s, full %v", at, full)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA is an in-memory CA for minting certs in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var testSerial int64
+
+// newTestCA gives a self-signed CA named cn, with a Subject Key Identifier.
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key := newTestKey(t)
+	cert := signTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil, key.Public(), key)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs template with the CA's key; with no Subject, it's a leaf for
+// leaf.example.  The new cert's key is returned too.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	if template.Subject.CommonName == "" {
+		template.Subject = pkix.Name{CommonName: "leaf.example"}
+		template.DNSNames = []string{"leaf.example"}
+	}
+	key := newTestKey(t)
+	return signTestCert(t, template, ca.cert, key.Public(), ca.key), key
+}
+
+func newTestKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	return key
+}
+
+// signTestCert makes a cert valid from an hour ago for a day; with a nil
+// parent, it's self-signed.  The Authority Key Identifier comes from the
+// parent's Subject Key Identifier, as x509.CreateCertificate does it.
+func signTestCert(t *testing.T, template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template.SerialNumber = big.NewInt(atomic.AddInt64(&testSerial, 1))
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatalf("creating cert %q: %s", template.Subject.CommonName, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing cert %q: %s", template.Subject.CommonName, err)
+	}
+	return cert
+}
+
+// writeLeaf issues a leaf with the given OCSP responders and writes it, with
+// the CA as its chain, to dir/name.
+func (ca *testCA) writeLeaf(t *testing.T, dir, name string, responders ...string) (string, *x509.Certificate) {
+	t.Helper()
+	leaf, _ := ca.issue(t, &x509.Certificate{OCSPServer: responders})
+	var data []byte
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	fn := filepath.Join(dir, name)
+	if err := os.WriteFile(fn, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fn, leaf
+}
+
+// testResponder is an OCSP responder for certs from one testCA, answering
+// "good" for anything, unless answer is set.  It tracks how many requests
+// it's handling at once, and which HTTP methods they used.
+type testResponder struct {
+	*httptest.Server
+	ca       *testCA
+	delay    time.Duration
+	postOnly bool // refuse GET requests, as some responders do
+
+	mu          sync.Mutex
+	answer      func(req *ocsp.Request) []byte // nil for a good response
+	methods     []string
+	requests    int
+	inFlight    int
+	maxInFlight int
+}
+
+func newTestResponder(t *testing.T, ca *testCA) *testResponder {
+	tr := &testResponder{ca: ca}
+	tr.Server = httptest.NewServer(http.HandlerFunc(tr.serveHTTP))
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+func (tr *testResponder) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	tr.mu.Lock()
+	tr.requests++
+	tr.methods = append(tr.methods, req.Method)
+	tr.inFlight++
+	if tr.inFlight > tr.maxInFlight {
+		tr.maxInFlight = tr.inFlight
+	}
+	answer := tr.answer
+	tr.mu.Unlock()
+	defer func() {
+		tr.mu.Lock()
+		tr.inFlight--
+		tr.mu.Unlock()
+	}()
+	time.Sleep(tr.delay)
+
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case req.Method == http.MethodPost:
+		body, err = io.ReadAll(req.Body)
+	case req.Method == http.MethodGet && !tr.postOnly:
+		body, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(req.URL.Path, "/"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ocspReq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var resp []byte
+	if answer != nil {
+		resp = answer(ocspReq)
+	} else {
+		now := time.Now()
+		resp = tr.ca.ocspResponse(ocspReq, ocsp.Response{
+			Status:     ocsp.Good,
+			ThisUpdate: now.Add(-time.Minute),
+			NextUpdate: now.Add(24 * time.Hour),
+		})
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = w.Write(resp)
+}
+
+// ocspResponse signs template as the answer to req, or panics: it's called
+// from HTTP handlers.
+func (ca *testCA) ocspResponse(req *ocsp.Request, template ocsp.Response) []byte {
+	template.SerialNumber = req.SerialNumber
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+// staple is a good response for leaf, valid for an hour, parsed and raw.
+func (ca *testCA) staple(t *testing.T, leaf *x509.Certificate) (*ocsp.Response, []byte) {
+	t.Helper()
+	now := time.Now()
+	raw := ca.ocspResponse(&ocsp.Request{SerialNumber: leaf.SerialNumber}, ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+	})
+	staple, err := ocsp.ParseResponseForCert(raw, leaf, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return staple, raw
+}
+
+func (tr *testResponder) counts() (requests, maxInFlight int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.requests, tr.maxInFlight
+}
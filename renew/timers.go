@@ -32,8 +32,20 @@ const (
 	SweepIntervalTimerless = 24 * time.Hour
 )
 
+// Defaults for the retry policy after failures, used when the corresponding
+// Config fields are zero.  Like DHCP, past T1 we try to renew; past T2 things
+// are getting urgent.  Before T2, repeated failures back off exponentially,
+// so that a responder which is broken for days isn't hammered; past T2 (or
+// with no usable staple at all) the cert is "in danger" and we retry often.
+const (
+	DefaultTimerT2         = 0.85
+	DefaultRetryBackoffMin = 15 * time.Minute
+	DefaultRetryBackoffMax = 12 * time.Hour
+	DefaultRetryInDanger   = 10 * time.Minute
+)
+
 func (cr *CertRenewal) timerMatch() bool {
-	raw, err := os.ReadFile(cr.staplePath)
+	raw, err := cr.readStaple()
 	if err != nil {
 		if os.IsNotExist(err) {
 			cr.CertLogf("no staple found reduces timer-match to 'yes'")
@@ -46,7 +58,7 @@ func (cr *CertRenewal) timerMatch() bool {
 		// would then want a way to change permission restoration so that we're
 		// not _always_ hitting this?  Although after first fetch, within
 		// process lifetime, should be running off data received so fine.
-		cr.CertLogf("ERROR reading staple to determine timer: %s", err)
+		cr.CertErrorf("ERROR reading staple to determine timer: %s", err)
 		return false
 	}
 
@@ -68,7 +80,7 @@ func (cr *CertRenewal) timerMatch() bool {
 	base := resp.ProducedAt
 	expire := resp.NextUpdate
 	now := time.Now()
-	t1ratio := cr.Renewer.config.TimerT1
+	t1ratio := cr.policy.timerT1
 	if expire.IsZero() {
 		cr.CertLogf("OCSP staple missing expiry time, need update")
 		return true
@@ -115,16 +127,11 @@ func (cr *CertRenewal) setRetryTimersFromStaple(staple *ocsp.Response) {
 		cr.RegisterFutureCheck(cr.certPath, time.Now().Add(retryJitter(offset)))
 	}
 
-	if staple == nil {
-		atOffset(RetryOnTryLater)
-		return
-	}
-
 	// See equivalent roughly matching logic in timerMatch
 	base := staple.ProducedAt
 	expire := staple.NextUpdate
 	now := time.Now()
-	t1ratio := cr.Renewer.config.TimerT1
+	t1ratio := cr.policy.timerT1
 	if expire.IsZero() {
 		atOffset(RetryMissingTimers)
 		return
@@ -140,13 +147,111 @@ func (cr *CertRenewal) setRetryTimersFromStaple(staple *ocsp.Response) {
 
 	retryAfter := base.Add(retryJitter(time.Duration(float64(expire.Sub(base)) * t1ratio)))
 	if now.After(retryAfter) {
-		atOffset(RetryAfterT1)
+		if cr.Renewer.inDanger(staple, now) {
+			atOffset(cr.Renewer.retryInDanger())
+		} else {
+			atOffset(RetryAfterT1)
+		}
 		return
 	}
 
 	cr.RegisterFutureCheck(cr.certPath, retryAfter)
 }
 
+// setRetryTimersAfterFailure schedules the next attempt after err.  Before T2
+// of the staple we still have, the interval doubles with each consecutive
+// failure, from RetryBackoffMin up to RetryBackoffMax, but never past T2.
+// Once in danger, we retry every RetryInDanger.
+func (cr *CertRenewal) setRetryTimersAfterFailure(err error) {
+	if !cr.NeedTimers() {
+		return
+	}
+	r := cr.Renewer
+	now := time.Now()
+	failures := r.consecutiveFailures(cr.certPath) + 1
+	staple := cr.oldStaple
+
+	if r.inDanger(staple, now) {
+		d := r.retryInDanger()
+		if staple == nil {
+			cr.CertWarnf("IN DANGER: failure %d with no usable staple; retrying in ~%s", failures, d)
+		} else {
+			cr.CertWarnf("IN DANGER: failure %d with staple expiring at %s; retrying in ~%s", failures, staple.NextUpdate, d)
+		}
+		cr.RegisterFutureCheck(cr.certPath, now.Add(retryJitter(d)))
+		return
+	}
+
+	d := r.retryBackoff(failures)
+	if re, ok := err.(ocsp.ResponseError); ok && re.Status == ocsp.TryLater && d < RetryOnTryLater {
+		d = RetryOnTryLater
+	}
+	retryAt := now.Add(retryJitter(d))
+	// Without a producedAt there's no T2 to hold back for: validityPoint
+	// would give us a time two thousand years ago.
+	if t2 := validityPoint(staple, r.timerT2()); !staple.ProducedAt.IsZero() && retryAt.After(t2) {
+		retryAt = t2
+	}
+	cr.CertLogf("failure %d, backing off: retry at %s", failures, retryAt)
+	cr.RegisterFutureCheck(cr.certPath, retryAt)
+}
+
+// validityPoint is the time that fraction of the way through the staple's
+// validity; as in timerMatch, we measure from producedAt.
+func validityPoint(staple *ocsp.Response, fraction float64) time.Time {
+	base := staple.ProducedAt
+	return base.Add(time.Duration(float64(staple.NextUpdate.Sub(base)) * fraction))
+}
+
+// inDanger says whether the staple is past T2, or missing or unusable.
+func (r *Renewer) inDanger(staple *ocsp.Response, now time.Time) bool {
+	if staple == nil || staple.NextUpdate.IsZero() || now.After(staple.NextUpdate) {
+		return true
+	}
+	if staple.ProducedAt.IsZero() {
+		return false
+	}
+	return now.After(validityPoint(staple, r.timerT2()))
+}
+
+func (r *Renewer) timerT2() float64 {
+	return effectiveTimerT2(r.config.TimerT2)
+}
+
+// effectiveTimerT2 gives the T2 in force for a configured (normalised) t2.
+func effectiveTimerT2(t2 float64) float64 {
+	if t2 > 0 {
+		return t2
+	}
+	return DefaultTimerT2
+}
+
+func (r *Renewer) retryInDanger() time.Duration {
+	if r.config.RetryInDanger > 0 {
+		return r.config.RetryInDanger
+	}
+	return DefaultRetryInDanger
+}
+
+// retryBackoff gives the interval before the next try after the given number
+// of consecutive failures.
+func (r *Renewer) retryBackoff(failures int) time.Duration {
+	d, limit := r.config.RetryBackoffMin, r.config.RetryBackoffMax
+	if d <= 0 {
+		d = DefaultRetryBackoffMin
+	}
+	if limit <= 0 {
+		limit = DefaultRetryBackoffMax
+	}
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
 func (r *Renewer) RegisterFutureCheck(path string, checkTime time.Time) {
 	if !r.NeedTimers() {
 		return
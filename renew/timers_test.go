@@ -0,0 +1,111 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	r := newTestRenewer(t, Config{RetryBackoffMin: time.Minute, RetryBackoffMax: 10 * time.Minute})
+	for failures, want := range []time.Duration{
+		time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute,
+	} {
+		if got := r.retryBackoff(failures); got != want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+
+	defaults := newTestRenewer(t, Config{})
+	if got := defaults.retryBackoff(1); got != DefaultRetryBackoffMin {
+		t.Errorf("default first backoff %s, want %s", got, DefaultRetryBackoffMin)
+	}
+	if got := defaults.retryBackoff(100); got != DefaultRetryBackoffMax {
+		t.Errorf("default longest backoff %s, want %s", got, DefaultRetryBackoffMax)
+	}
+}
+
+func TestSetRetryTimersAfterFailure(t *testing.T) {
+	r := newTestRenewer(t, Config{
+		TimerT2:         0.9,
+		RetryBackoffMin: time.Minute,
+		RetryBackoffMax: time.Hour,
+		RetryInDanger:   5 * time.Minute,
+	})
+	r.needTimers = true
+	cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", policy: r.basePolicy}
+
+	// Valid for 100 hours, so T2 is 90 hours after producedAt.
+	stapleWithT2In := func(d time.Duration) *ocsp.Response {
+		produced := time.Now().Add(d - 90*time.Hour)
+		return &ocsp.Response{ProducedAt: produced, ThisUpdate: produced, NextUpdate: produced.Add(100 * time.Hour)}
+	}
+	tryLater := ocsp.ResponseError{Status: ocsp.TryLater}
+	exactly := func(d time.Duration) [2]time.Duration { return [2]time.Duration{d, d} }
+	jittered := func(d time.Duration) [2]time.Duration { return [2]time.Duration{d * 9 / 10, d * 11 / 10} }
+
+	for _, tc := range []struct {
+		name          string
+		staple        *ocsp.Response
+		priorFailures int
+		err           error
+		want          [2]time.Duration // range of the retry interval
+	}{
+		{"first failure", stapleWithT2In(24 * time.Hour), 0, ErrHTTPFailure, jittered(time.Minute)},
+		{"third failure", stapleWithT2In(24 * time.Hour), 2, ErrHTTPFailure, jittered(4 * time.Minute)},
+		{"backoff limit", stapleWithT2In(24 * time.Hour), 20, ErrHTTPFailure, jittered(time.Hour)},
+		{"tryLater waits longer", stapleWithT2In(24 * time.Hour), 0, tryLater, jittered(RetryOnTryLater)},
+		{"never past T2", stapleWithT2In(10 * time.Minute), 20, ErrHTTPFailure, exactly(10 * time.Minute)},
+		{"in danger past T2", stapleWithT2In(-time.Minute), 20, ErrHTTPFailure, jittered(5 * time.Minute)},
+		{"in danger without staple", nil, 0, ErrHTTPFailure, jittered(5 * time.Minute)},
+		{"in danger when expired", stapleWithT2In(-11 * time.Hour), 0, errors.New("dial failed"), jittered(5 * time.Minute)},
+		{"no producedAt, so no T2", &ocsp.Response{ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, 2, ErrHTTPFailure, jittered(4 * time.Minute)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r.nextRenew = make(map[string]time.Time)
+			r.certStatus = map[string]*CertStatus{cr.certPath: {Path: cr.certPath, ConsecutiveFailures: tc.priorFailures}}
+			cr.oldStaple = tc.staple
+
+			before := time.Now()
+			cr.setRetryTimersAfterFailure(tc.err)
+			after := time.Now()
+
+			at, ok := r.nextRenew[cr.certPath]
+			if !ok {
+				t.Fatal("no retry scheduled")
+			}
+			// Allow for the clock moving on while the test runs.
+			earliest, latest := before.Add(tc.want[0]-time.Second), after.Add(tc.want[1]+time.Second)
+			if at.Before(earliest) || at.After(latest) {
+				t.Errorf("retry in %s, want between %s and %s", at.Sub(before), tc.want[0], tc.want[1])
+			}
+		})
+	}
+}
+
+func TestInDanger(t *testing.T) {
+	r := newTestRenewer(t, Config{TimerT2: 0.9})
+	now := time.Now()
+	produced := now.Add(-50 * time.Hour)
+	for _, tc := range []struct {
+		name   string
+		staple *ocsp.Response
+		want   bool
+	}{
+		{"no staple", nil, true},
+		{"no nextUpdate", &ocsp.Response{ProducedAt: produced}, true},
+		{"halfway", &ocsp.Response{ProducedAt: produced, NextUpdate: produced.Add(100 * time.Hour)}, false},
+		{"past T2", &ocsp.Response{ProducedAt: produced, NextUpdate: produced.Add(55 * time.Hour)}, true},
+		{"expired", &ocsp.Response{ProducedAt: produced, NextUpdate: now.Add(-time.Minute)}, true},
+	} {
+		if got := r.inDanger(tc.staple, now); got != tc.want {
+			t.Errorf("%s: inDanger %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
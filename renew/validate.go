@@ -0,0 +1,115 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultMaxClockSkew is used when Config.MaxClockSkew is zero.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// Reasons for a RejectedStapleError; use errors.Is to check.
+var (
+	ErrThisUpdateInFuture   = errors.New("thisUpdate is in the future")
+	ErrMissingNextUpdate    = errors.New("nextUpdate is missing")
+	ErrNextUpdateBeforeThis = errors.New("nextUpdate is before thisUpdate")
+	ErrValidityTooShort     = errors.New("validity window is too short")
+	ErrUnauthorizedSigner   = errors.New("response not signed by issuer or an authorized OCSP responder")
+	ErrStapleRegression     = errors.New("response is older than the existing staple")
+)
+
+// validateStaple is the policy check between fetching a response and
+// installing it.  A response which a TLS client would reject is worse than
+// keeping the existing staple until it expires, so anything failing here is
+// not written.  ocsp.ParseResponseForCert has already checked signatures.
+func (cr *CertRenewal) validateStaple(staple *ocsp.Response) error {
+	reject := func(reason error, spec string, args ...interface{}) error {
+		cr.Renewer.metrics.stapleRejected(reason)
+		return RejectedStapleError{Cert: cr.cert, Reason: reason, Detail: fmt.Sprintf(spec, args...)}
+	}
+
+	now := time.Now()
+	skew := cr.Renewer.config.MaxClockSkew
+	if skew == 0 {
+		skew = DefaultMaxClockSkew
+	}
+
+	if staple.ThisUpdate.After(now.Add(skew)) {
+		return reject(ErrThisUpdateInFuture, "thisUpdate %s is more than %s ahead of now", staple.ThisUpdate, skew)
+	}
+	if staple.NextUpdate.IsZero() {
+		return reject(ErrMissingNextUpdate, "no nextUpdate")
+	}
+	if staple.NextUpdate.Before(staple.ThisUpdate) {
+		return reject(ErrNextUpdateBeforeThis, "nextUpdate %s before thisUpdate %s", staple.NextUpdate, staple.ThisUpdate)
+	}
+	if window := staple.NextUpdate.Sub(staple.ThisUpdate); window < cr.Renewer.config.MinValidity {
+		return reject(ErrValidityTooShort, "validity %s less than minimum %s", window, cr.Renewer.config.MinValidity)
+	}
+
+	if err := checkResponderAuthorized(staple.Certificate, cr.issuer, now); err != nil {
+		return reject(ErrUnauthorizedSigner, "%s", err)
+	}
+
+	return nil
+}
+
+// checkResponderAuthorized applies RFC 6960 §4.2.2.2: the response is signed
+// by the issuer itself or by a responder cert which the issuer issued with
+// the id-kp-OCSPSigning extended key usage.  A nil responder means the
+// response carried no cert, so was verified against the issuer directly.
+func checkResponderAuthorized(responder, issuer *x509.Certificate, now time.Time) error {
+	if responder == nil || bytes.Equal(responder.Raw, issuer.Raw) {
+		return nil
+	}
+	if err := responder.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("responder cert %q not issued by %q: %w", certLabel(responder), certLabel(issuer), err)
+	}
+	if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+		return fmt.Errorf("responder cert %q not valid now (%s to %s)", certLabel(responder), responder.NotBefore, responder.NotAfter)
+	}
+	for _, eku := range responder.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			return nil
+		}
+	}
+	return fmt.Errorf("responder cert %q lacks id-kp-OCSPSigning", certLabel(responder))
+}
+
+// checkNotRegression refuses to replace the existing staple with one which is
+// older or which expires sooner: load-balanced responders can serve a stale
+// cached response.  Equal is fine.
+func (cr *CertRenewal) checkNotRegression(staple *ocsp.Response) error {
+	old := cr.oldStaple
+	if old == nil || cr.Renewer.config.AllowStapleRegression {
+		return nil
+	}
+	reject := func(field string, was, now time.Time) error {
+		cr.Renewer.metrics.stapleRejected(ErrStapleRegression)
+		return RejectedStapleError{
+			Cert:   cr.cert,
+			Reason: ErrStapleRegression,
+			Detail: fmt.Sprintf("%s would go back from %s to %s", field, was, now),
+		}
+	}
+
+	if staple.ProducedAt.Before(old.ProducedAt) {
+		return reject("producedAt", old.ProducedAt, staple.ProducedAt)
+	}
+	if staple.ThisUpdate.Before(old.ThisUpdate) {
+		return reject("thisUpdate", old.ThisUpdate, staple.ThisUpdate)
+	}
+	if !old.NextUpdate.IsZero() && staple.NextUpdate.Before(old.NextUpdate) {
+		return reject("nextUpdate", old.NextUpdate, staple.NextUpdate)
+	}
+	return nil
+}
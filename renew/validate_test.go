@@ -0,0 +1,128 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestValidateStapleTimes(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	r := newTestRenewer(t, Config{MinValidity: time.Hour})
+	cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", issuer: ca.cert}
+	cr.cert, _ = ca.issue(t, &x509.Certificate{})
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name       string
+		thisUpdate time.Time
+		nextUpdate time.Time
+		want       error
+	}{
+		{"good", now.Add(-time.Minute), now.Add(2 * time.Hour), nil},
+		{"thisUpdate within skew", now.Add(2 * time.Minute), now.Add(2 * time.Hour), nil},
+		{"thisUpdate beyond skew", now.Add(10 * time.Minute), now.Add(2 * time.Hour), ErrThisUpdateInFuture},
+		{"no nextUpdate", now.Add(-time.Minute), time.Time{}, ErrMissingNextUpdate},
+		{"nextUpdate before thisUpdate", now.Add(-time.Minute), now.Add(-2 * time.Minute), ErrNextUpdateBeforeThis},
+		{"validity exactly the minimum", now.Add(-time.Minute), now.Add(59 * time.Minute), nil},
+		{"validity too short", now.Add(-time.Minute), now.Add(30 * time.Minute), ErrValidityTooShort},
+	} {
+		err := cr.validateStaple(&ocsp.Response{Status: ocsp.Good, ThisUpdate: tc.thisUpdate, NextUpdate: tc.nextUpdate})
+		var rse RejectedStapleError
+		switch {
+		case tc.want == nil && err != nil:
+			t.Errorf("%s: got %v, want no error", tc.name, err)
+		case tc.want != nil && (!errors.As(err, &rse) || !errors.Is(err, tc.want)):
+			t.Errorf("%s: got %v, want RejectedStapleError for %v", tc.name, err, tc.want)
+		}
+	}
+
+	if got := r.metrics.rejections[rejectionLabels[ErrValidityTooShort]]; got != 1 {
+		t.Errorf("validity too short rejections metric %d, want 1", got)
+	}
+}
+
+func TestCheckResponderAuthorized(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	responder := func(ca *testCA, eku x509.ExtKeyUsage, notAfter time.Time) *x509.Certificate {
+		cert, _ := ca.issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "Test OCSP responder"},
+			ExtKeyUsage: []x509.ExtKeyUsage{eku},
+			NotBefore:   time.Now().Add(-2 * time.Hour),
+			NotAfter:    notAfter,
+		})
+		return cert
+	}
+	tomorrow := time.Now().Add(24 * time.Hour)
+
+	for _, tc := range []struct {
+		name      string
+		responder *x509.Certificate
+		ok        bool
+	}{
+		{"no cert in the response", nil, true},
+		{"the issuer itself", ca.cert, true},
+		{"delegated responder", responder(ca, x509.ExtKeyUsageOCSPSigning, tomorrow), true},
+		{"without OCSPSigning", responder(ca, x509.ExtKeyUsageServerAuth, tomorrow), false},
+		{"expired delegated responder", responder(ca, x509.ExtKeyUsageOCSPSigning, time.Now().Add(-time.Hour)), false},
+		{"another CA's responder", responder(other, x509.ExtKeyUsageOCSPSigning, tomorrow), false},
+		{"another CA", other.cert, false},
+	} {
+		err := checkResponderAuthorized(tc.responder, ca.cert, time.Now())
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckNotRegression(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := &ocsp.Response{
+		ProducedAt: base,
+		ThisUpdate: base,
+		NextUpdate: base.Add(7 * 24 * time.Hour),
+	}
+	for _, tc := range []struct {
+		name       string
+		old        *ocsp.Response
+		allow      bool
+		producedAt time.Duration // all relative to old's
+		thisUpdate time.Duration
+		nextUpdate time.Duration
+		wantReject bool
+	}{
+		{"no existing staple", nil, false, -time.Hour, -time.Hour, -time.Hour, false},
+		{"newer", old, false, time.Hour, time.Hour, time.Hour, false},
+		{"identical", old, false, 0, 0, 0, false},
+		{"older producedAt", old, false, -time.Second, 0, 0, true},
+		{"older thisUpdate", old, false, 0, -time.Second, 0, true},
+		{"shorter-lived", old, false, time.Hour, time.Hour, -time.Second, true},
+		{"older, but allowed", old, true, -time.Hour, -time.Hour, -time.Hour, false},
+		{"old one had no nextUpdate", &ocsp.Response{ProducedAt: base, ThisUpdate: base}, false, time.Hour, time.Hour, -7 * 24 * time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRenewer(t, Config{AllowStapleRegression: tc.allow})
+			cr := &CertRenewal{Renewer: r, certPath: "leaf.crt", oldStaple: tc.old}
+			err := cr.checkNotRegression(&ocsp.Response{
+				ProducedAt: old.ProducedAt.Add(tc.producedAt),
+				ThisUpdate: old.ThisUpdate.Add(tc.thisUpdate),
+				NextUpdate: old.NextUpdate.Add(tc.nextUpdate),
+			})
+			switch {
+			case tc.wantReject && !errors.Is(err, ErrStapleRegression):
+				t.Errorf("got %v, want rejection for %v", err, ErrStapleRegression)
+			case !tc.wantReject && err != nil:
+				t.Errorf("got %v, want no error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchSettleDelay is how long a watched directory must be quiet before we act
+// on changes within it, so that a cert being written out in pieces, or a
+// cert/key/chain trio being replaced, is handled once.
+const WatchSettleDelay = 2 * time.Second
+
+// dirWatcher watches input directories, in -dirs mode, and hands the paths of
+// changed candidate certs to the persist loop.  We don't act on what changed,
+// just that something did: the loop looks at the file as it is by then.
+//
+// Atomic rename-into-place and symlink swaps in the directory both show up as
+// a create of the final name.  If an input directory is itself a symlink, we
+// also watch its parent so that we can follow the link being re-pointed.
+type dirWatcher struct {
+	r *Renewer
+	w *fsnotify.Watcher
+
+	dirs  map[string]bool   // input directories, cleaned
+	links map[string]string // cleaned symlinked input dir => input dir as given
+
+	pending map[string]struct{}
+
+	done chan struct{} // closed when run returns
+}
+
+func (r *Renewer) startWatching() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dw := &dirWatcher{
+		r:       r,
+		w:       w,
+		dirs:    make(map[string]bool),
+		links:   make(map[string]string),
+		pending: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, d := range r.config.InputPaths {
+		if err := dw.addDir(d); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	r.watcher = dw
+	go dw.run()
+	return nil
+}
+
+func (dw *dirWatcher) addDir(d string) error {
+	if err := dw.w.Add(d); err != nil {
+		return err
+	}
+	dw.dirs[filepath.Clean(d)] = true
+	dw.r.LogAtf(1, "watching directory %q for cert changes", d)
+
+	fi, err := os.Lstat(d)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		parent := filepath.Dir(filepath.Clean(d))
+		if err := dw.w.Add(parent); err != nil {
+			dw.r.Logf("unable to watch %q for changes to symlink %q: %s", parent, d, err)
+		} else {
+			dw.links[filepath.Clean(d)] = d
+		}
+	}
+	return nil
+}
+
+// stopWatching stops the watcher, if any, returning once it's stopped.
+func (r *Renewer) stopWatching() {
+	if r.watcher == nil {
+		return
+	}
+	_ = r.watcher.w.Close()
+	<-r.watcher.done
+	r.watcher = nil
+}
+
+func (dw *dirWatcher) run() {
+	defer close(dw.done)
+	settle := time.NewTimer(WatchSettleDelay)
+	settle.Stop()
+
+	for {
+		select {
+		case ev, ok := <-dw.w.Events:
+			if !ok {
+				return
+			}
+			if dw.handleEvent(ev) {
+				settle.Reset(WatchSettleDelay)
+			}
+		case err, ok := <-dw.w.Errors:
+			if !ok {
+				return
+			}
+			dw.r.Logf("directory watch error: %s", err)
+		case <-settle.C:
+			paths := make([]string, 0, len(dw.pending))
+			for p := range dw.pending {
+				paths = append(paths, p)
+			}
+			dw.pending = make(map[string]struct{})
+			dw.r.LogAtf(1, "directory watch: %d paths changed", len(paths))
+			dw.r.queuePaths(paths)
+		}
+	}
+}
+
+// handleEvent returns true if it queued anything
+func (dw *dirWatcher) handleEvent(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+
+	if d, ok := dw.links[filepath.Clean(ev.Name)]; ok {
+		dw.r.Logf("directory watch: symlinked input dir %q changed (%s), re-watching", d, ev.Op)
+		_ = dw.w.Remove(d)
+		if err := dw.w.Add(d); err != nil {
+			dw.r.Logf("directory watch: unable to re-watch %q: %s", d, err)
+		}
+		// Everything in there is potentially new, and everything we knew
+		// about might be gone.
+		for _, p := range dw.r.candidatesIn(d) {
+			dw.pending[p] = struct{}{}
+		}
+		for _, p := range dw.r.trackedPaths() {
+			if filepath.Dir(p) == filepath.Clean(d) {
+				dw.pending[p] = struct{}{}
+			}
+		}
+		return true
+	}
+
+	if !dw.dirs[filepath.Dir(ev.Name)] {
+		// the parent of a symlinked dir has lots of other stuff
+		return false
+	}
+
+	p := strings.TrimSuffix(ev.Name, NoOCSPExtension)
+	if !dw.r.isCertCandidate(p) {
+		return false
+	}
+	dw.r.LogAtf(2, "directory watch: %s %q", ev.Op, ev.Name)
+	dw.pending[p] = struct{}{}
+	return true
+}
+
+// isCertCandidate applies the same filename rules as a directory scan.
+func (r *Renewer) isCertCandidate(p string) bool {
+	base := filepath.Base(p)
+	for _, excludeExt := range ExcludeExtensions {
+		if strings.HasSuffix(base, excludeExt) {
+			return false
+		}
+	}
+	for _, g := range r.certGlobs {
+		if ok, _ := filepath.Match(g, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Renewer) candidatesIn(dirname string) []string {
+	var candidates []string
+	for _, g := range r.certGlobs {
+		m, err := filepath.Glob(filepath.Join(dirname, g))
+		if err == nil {
+			candidates = append(candidates, m...)
+		}
+	}
+	return candidates
+}
+
+// queuePaths hands paths to the persist loop to be looked at soon, waking it
+// up if it's sleeping.
+func (r *Renewer) queuePaths(paths []string) {
+	r.renewMutex.Lock()
+	r.pendingPaths = append(r.pendingPaths, paths...)
+	r.renewMutex.Unlock()
+
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Renewer) takePendingPaths() []string {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	paths := r.pendingPaths
+	r.pendingPaths = nil
+	return paths
+}
+
+// renewPendingPaths handles paths queued by the watcher: gone (or flagged
+// with .noocsp) and we stop tracking them, else they're handled as in a
+// directory scan, with the normal timer rules.  A replaced cert won't match
+// the existing staple, so will be renewed.
+func (r *Renewer) renewPendingPaths() {
+	paths := r.takePendingPaths()
+	if len(paths) == 0 {
+		return
+	}
+	seen := make(map[string]bool, len(paths))
+	var check []string
+	for _, p := range paths {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		if _, err := os.Stat(p); err != nil {
+			r.forgetPath(p)
+			continue
+		}
+		if _, err := os.Stat(p + NoOCSPExtension); err == nil {
+			r.forgetPath(p)
+			continue
+		}
+		if !r.coveredByInputs(p) {
+			// queued before a reload took its directory away
+			r.forgetPath(p)
+			continue
+		}
+		r.Logf("directory watch: checking %q", p)
+		check = append(check, p)
+	}
+	_ = r.forEachConcurrently(check, r.oneFilenameSuccess)
+}
+
+func (r *Renewer) trackedPaths() []string {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+	paths := make([]string, 0, len(r.certStatus))
+	for p := range r.certStatus {
+		paths = append(paths, p)
+	}
+	for p := range r.nextRenew {
+		if _, ok := r.certStatus[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// forgetPath stops tracking a cert: no more timers, no more status, and no
+// memory of notifications sent.  It returns false if we weren't tracking it.
+func (r *Renewer) forgetPath(p string) bool {
+	r.renewMutex.Lock()
+	_, timed := r.nextRenew[p]
+	_, known := r.certStatus[p]
+	if !timed && !known {
+		r.renewMutex.Unlock()
+		return false
+	}
+	delete(r.nextRenew, p)
+	delete(r.certStatus, p)
+	r.recomputeEarliestNextRenew()
+	r.renewMutex.Unlock()
+
+	r.notifier.forget(p)
+	r.Logf("no longer tracking %q", p)
+	return true
+}
+
+// recomputeEarliestNextRenew is for after removing from nextRenew; the caller
+// must hold renewMutex.
+func (r *Renewer) recomputeEarliestNextRenew() {
+	r.earliestNextRenew = time.Time{}
+	for _, t := range r.nextRenew {
+		if r.earliestNextRenew.IsZero() || t.Before(r.earliestNextRenew) {
+			r.earliestNextRenew = t
+		}
+	}
+}
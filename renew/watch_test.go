@@ -0,0 +1,198 @@
+// Copyright © 2017 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package renew // import "go.pennock.tech/ocsprenewer/renew"
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// newTestWatcher is startWatching without the goroutine, so that tests can
+// feed events to handleEvent themselves.
+func newTestWatcher(t *testing.T, r *Renewer) *dirWatcher {
+	t.Helper()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	dw := &dirWatcher{
+		r:       r,
+		w:       w,
+		dirs:    make(map[string]bool),
+		links:   make(map[string]string),
+		pending: make(map[string]struct{}),
+	}
+	for _, d := range r.config.InputPaths {
+		if err := dw.addDir(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dw
+}
+
+func touch(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if err := os.WriteFile(p, []byte("not really a cert\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIsCertCandidate(t *testing.T) {
+	r := newTestRenewer(t, Config{CertExtensions: ".crt .pem"})
+	for p, want := range map[string]bool{
+		"/etc/ssl/site.crt":         true,
+		"/etc/ssl/site.pem":         true,
+		"site.crt":                  true,
+		"/etc/ssl/site.key":         false,
+		"/etc/ssl/site.crt.noocsp":  false,
+		"/etc/ssl/site.crt.ocsp":    false,
+		"/etc/lego/site.issuer.crt": false,
+		"/etc/ssl/crt":              false,
+	} {
+		if got := r.isCertCandidate(p); got != want {
+			t.Errorf("isCertCandidate(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestWatchHandleEvent(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{dir}})
+	dw := newTestWatcher(t, r)
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, tc := range []struct {
+		name   string
+		ev     fsnotify.Event
+		queued string // empty for nothing
+	}{
+		{"new cert", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Create}, in("site.crt")},
+		{"rewritten cert", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Write}, in("site.crt")},
+		{"renamed into place", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Rename}, in("site.crt")},
+		{"removed", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Remove}, in("site.crt")},
+		{"write with chmod", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Write | fsnotify.Chmod}, in("site.crt")},
+		{"chmod alone", fsnotify.Event{Name: in("site.crt"), Op: fsnotify.Chmod}, ""},
+		{"noocsp flag added", fsnotify.Event{Name: in("site.crt.noocsp"), Op: fsnotify.Create}, in("site.crt")},
+		{"not a cert", fsnotify.Event{Name: in("site.key"), Op: fsnotify.Create}, ""},
+		{"our own staple", fsnotify.Event{Name: in("site.crt.ocsp"), Op: fsnotify.Create}, ""},
+		{"in a subdirectory", fsnotify.Event{Name: filepath.Join(dir, "old", "site.crt"), Op: fsnotify.Create}, ""},
+	} {
+		dw.pending = make(map[string]struct{})
+		got := dw.handleEvent(tc.ev)
+		if got != (tc.queued != "") {
+			t.Errorf("%s: handleEvent returned %v", tc.name, got)
+		}
+		_, ok := dw.pending[tc.queued]
+		if tc.queued != "" && (!ok || len(dw.pending) != 1) {
+			t.Errorf("%s: pending %v, want just %q", tc.name, dw.pending, tc.queued)
+		}
+		if tc.queued == "" && len(dw.pending) != 0 {
+			t.Errorf("%s: pending %v, want nothing", tc.name, dw.pending)
+		}
+	}
+}
+
+func TestWatchSymlinkedInputDir(t *testing.T) {
+	base := t.TempDir()
+	oldTarget, newTarget := filepath.Join(base, "v1"), filepath.Join(base, "v2")
+	for _, d := range []string{oldTarget, newTarget} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(t, filepath.Join(oldTarget, "old.crt"), filepath.Join(newTarget, "new.crt"), filepath.Join(newTarget, "new.key"))
+	live := filepath.Join(base, "live")
+	if err := os.Symlink("v1", live); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{live}})
+	dw := newTestWatcher(t, r)
+	r.nextRenew[filepath.Join(live, "old.crt")] = time.Now().Add(time.Hour)
+
+	// The parent is watched only to see the link change.
+	if dw.handleEvent(fsnotify.Event{Name: filepath.Join(base, "unrelated.crt"), Op: fsnotify.Create}) {
+		t.Errorf("event for a cert in the symlink's parent was queued: %v", dw.pending)
+	}
+
+	if err := os.Remove(live); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v2", live); err != nil {
+		t.Fatal(err)
+	}
+	if !dw.handleEvent(fsnotify.Event{Name: live, Op: fsnotify.Create}) {
+		t.Fatal("re-pointing the symlink queued nothing")
+	}
+	var pending []string
+	for p := range dw.pending {
+		pending = append(pending, p)
+	}
+	sort.Strings(pending)
+	want := []string{filepath.Join(live, "new.crt"), filepath.Join(live, "old.crt")}
+	if len(pending) != len(want) || pending[0] != want[0] || pending[1] != want[1] {
+		t.Errorf("pending %q, want %q: the new target's certs and the ones we tracked", pending, want)
+	}
+
+	// The watch must now be on the new target.
+	touch(t, filepath.Join(newTarget, "another.crt"))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-dw.w.Events:
+			if ev.Name == filepath.Join(live, "another.crt") {
+				return
+			}
+		case err := <-dw.w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no event for a cert created in the new symlink target")
+		}
+	}
+}
+
+func TestRenewPendingPaths(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenewer(t, Config{Directories: true, InputPaths: []string{dir}})
+	r.SetNotReally(true)
+
+	removed, flagged, present := filepath.Join(dir, "removed.crt"), filepath.Join(dir, "flagged.crt"), filepath.Join(dir, "present.crt")
+	touch(t, flagged, flagged+NoOCSPExtension, present)
+	soon := time.Now().Add(time.Minute)
+	for i, p := range []string{removed, flagged, present} {
+		r.nextRenew[p] = soon.Add(time.Duration(i) * time.Hour)
+		r.certStatus[p] = &CertStatus{Path: p}
+	}
+	r.earliestNextRenew = soon
+
+	r.queuePaths([]string{removed, flagged, present, removed})
+	r.renewPendingPaths()
+
+	for _, p := range []string{removed, flagged} {
+		if _, ok := r.nextRenew[p]; ok {
+			t.Errorf("%q still has a timer", p)
+		}
+		if _, ok := r.certStatus[p]; ok {
+			t.Errorf("%q still has a status", p)
+		}
+	}
+	if _, ok := r.certStatus[present]; !ok {
+		t.Errorf("%q, which is still there, was forgotten", present)
+	}
+	if want := soon.Add(2 * time.Hour); !r.earliestNextRenew.Equal(want) {
+		t.Errorf("earliest next renew %s, want %s from what's left", r.earliestNextRenew, want)
+	}
+	if paths := r.takePendingPaths(); len(paths) != 0 {
+		t.Errorf("paths still pending: %q", paths)
+	}
+}